@@ -1,8 +1,80 @@
 package main
 
+import (
+	"fmt"
+	"strings"
+)
+
 type document struct {
 	title string
 	parts []docPart
+	// positions are where the parts are in the source, positions[i] belongs
+	// to parts[i]. Documents that were not parsed from source may have no
+	// positions.
+	positions []sourceRange
+}
+
+// sourcePos is a position in the source code. line and column are 1-indexed,
+// the column counts characters, not bytes. A column of 0 means that only the
+// line is known.
+type sourcePos struct {
+	line, column int
+}
+
+// sourceRange is the part of the source code that a docPart was created from.
+// end is the position right behind the last character.
+type sourceRange struct {
+	file       string
+	start, end sourcePos
+}
+
+func (r sourceRange) String() string {
+	var pos string
+	if r.file != "" {
+		pos = fmt.Sprintf("%s:%d", r.file, r.start.line)
+		if r.start.column > 0 {
+			pos += fmt.Sprintf(":%d", r.start.column)
+		}
+	} else {
+		pos = fmt.Sprintf("line %d", r.start.line)
+		if r.start.column > 0 {
+			pos += fmt.Sprintf(", column %d", r.start.column)
+		}
+	}
+	return pos
+}
+
+// position returns the source range of the i'th part or an empty range if it
+// is not known.
+func (doc document) position(i int) sourceRange {
+	if i < len(doc.positions) {
+		return doc.positions[i]
+	}
+	return sourceRange{}
+}
+
+// errorAt prefixes the error with the source position of the i'th part, if it
+// is known.
+func (doc document) errorAt(i int, err error) error {
+	pos := doc.position(i)
+	if pos.start.line == 0 {
+		return err
+	}
+	return fmt.Errorf("%s: %s", pos, err.Error())
+}
+
+// walk calls f for every part of the document and its source range. The parts
+// of an admonition's or footnote's content come right after it.
+func (doc document) walk(f func(part docPart, pos sourceRange)) {
+	for i, part := range doc.parts {
+		f(part, doc.position(i))
+		switch p := part.(type) {
+		case docAdmonition:
+			p.content.walk(f)
+		case docFootnote:
+			p.content.walk(f)
+		}
+	}
 }
 
 type docPart interface {
@@ -10,41 +82,206 @@ type docPart interface {
 }
 
 type (
-	docText          string
-	docTitle         string
-	docCaption       string
-	docSubCaption    string
-	docSubSubCaption string
+	docText string
+
+	// docParagraphBreak separates two paragraphs of text. Captions also end
+	// the current paragraph.
+	docParagraphBreak struct{}
+
+	// docLineBreak forces a line break inside a paragraph.
+	docLineBreak     struct{}
+	docTitle         heading
+	docCaption       heading
+	docSubCaption    heading
+	docSubSubCaption heading
+
+	// heading is the content of all caption types. Every heading has a unique
+	// id that can be used as a link target.
+	heading struct {
+		text string
+		id   string
+	}
 
 	stylizedDocText struct {
-		text         string
-		bold, italic bool
+		text  string
+		style textStyle
 	}
 
+	// docCode is literal text like a file name or command, it is shown in a
+	// monospace font.
+	docCode string
+
+	// docKey is a key or key combination on the keyboard, e.g. "Ctrl+S".
+	docKey string
+
 	docImage struct {
 		name string
 	}
 
+	// docLink is a link to the heading with the given id. Links inside
+	// styled text have the style of that text.
 	docLink struct {
-		id   int
-		text string
+		id    string
+		text  string
+		style textStyle
 	}
 
-	docLinkTarget int
-
 	externalDocLink struct {
-		url  string
-		text string
+		url   string
+		text  string
+		style textStyle
 	}
+
+	// docFootnote is the reference to a footnote, the footnotes are numbered
+	// from 1 in the order of their references. Their content is inline text
+	// and line breaks.
+	docFootnote struct {
+		number  int
+		content document
+	}
+
+	// docAdmonition is a box that stands out from the text around it, like a
+	// warning. Its content has paragraphs of its own but no captions.
+	docAdmonition struct {
+		kind    admonitionKind
+		content document
+	}
+)
+
+// admonitionKind tells how important an admonition is, the kinds are written
+// in the source code as they are.
+type admonitionKind string
+
+const (
+	admonitionNote    admonitionKind = "note"
+	admonitionTip     admonitionKind = "tip"
+	admonitionWarning admonitionKind = "warning"
+	admonitionDanger  admonitionKind = "danger"
+)
+
+var admonitionKinds = []admonitionKind{
+	admonitionNote,
+	admonitionTip,
+	admonitionWarning,
+	admonitionDanger,
+}
+
+// findAdmonitionKind returns the kind with the given name, ignoring case.
+func findAdmonitionKind(name string) (admonitionKind, bool) {
+	for _, kind := range admonitionKinds {
+		if strings.EqualFold(name, string(kind)) {
+			return kind, true
+		}
+	}
+	return "", false
+}
+
+// title is the label that generators show above the admonition's content.
+func (k admonitionKind) title() string {
+	return strings.ToUpper(string(k[:1])) + string(k[1:])
+}
+
+// textStyle is a set of inline styles, they are combined with |.
+type textStyle uint
+
+const (
+	styleBold textStyle = 1 << iota
+	styleItalic
+	styleUnderline
+	styleStrike
+	styleSuper
+	styleSub
+	styleHighlight
 )
 
-func (docText) isDocPart()          {}
-func (stylizedDocText) isDocPart()  {}
-func (docImage) isDocPart()         {}
-func (docLink) isDocPart()          {}
-func (docLinkTarget) isDocPart()    {}
-func (docTitle) isDocPart()         {}
-func (docCaption) isDocPart()       {}
-func (docSubCaption) isDocPart()    {}
-func (docSubSubCaption) isDocPart() {}
-func (externalDocLink) isDocPart()  {}
+const superOrSub = styleSuper | styleSub
+
+// has returns true if all styles in flags are set.
+func (s textStyle) has(flags textStyle) bool {
+	return s&flags == flags
+}
+
+func (docText) isDocPart()           {}
+func (docParagraphBreak) isDocPart() {}
+func (docLineBreak) isDocPart()      {}
+func (stylizedDocText) isDocPart()   {}
+func (docCode) isDocPart()           {}
+func (docKey) isDocPart()            {}
+func (docImage) isDocPart()          {}
+func (docLink) isDocPart()           {}
+func (docTitle) isDocPart()          {}
+func (docCaption) isDocPart()        {}
+func (docSubCaption) isDocPart()     {}
+func (docSubSubCaption) isDocPart()  {}
+func (externalDocLink) isDocPart()   {}
+func (docAdmonition) isDocPart()     {}
+func (docFootnote) isDocPart()       {}
+
+// headingOf returns the heading of a caption part and its level, which is 1
+// for the title, 2 for captions, 3 for sub-captions and 4 for
+// sub-sub-captions. ok is false if the part is not a caption.
+func headingOf(part docPart) (h heading, level int, ok bool) {
+	switch p := part.(type) {
+	case docTitle:
+		return heading(p), 1, true
+	case docCaption:
+		return heading(p), 2, true
+	case docSubCaption:
+		return heading(p), 3, true
+	case docSubSubCaption:
+		return heading(p), 4, true
+	}
+	return heading{}, 0, false
+}
+
+// withHeading returns a caption part of the given level, see headingOf.
+func withHeading(h heading, level int) docPart {
+	switch level {
+	case 1:
+		return docTitle(h)
+	case 2:
+		return docCaption(h)
+	case 3:
+		return docSubCaption(h)
+	default:
+		return docSubSubCaption(h)
+	}
+}
+
+// bookmarkNames maps the ids of all headings in the document to bookmark
+// names that word processors accept. These may only contain ASCII letters,
+// digits and underscores and Word ignores names longer than 40 characters.
+// Ids that would get the same name are numbered to keep the names unique.
+func bookmarkNames(doc document) map[string]string {
+	const maxLen = 40
+	names := make(map[string]string)
+	used := make(map[string]bool)
+	for _, part := range doc.parts {
+		h, _, ok := headingOf(part)
+		if !ok {
+			continue
+		}
+		base := []byte("_")
+		for _, r := range h.id {
+			if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+				base = append(base, byte(r))
+			} else {
+				base = append(base, '_')
+			}
+		}
+		if len(base) > maxLen {
+			base = base[:maxLen]
+		}
+		name := string(base)
+		for n := 2; used[name]; n++ {
+			suffix := fmt.Sprintf("_%d", n)
+			if len(base) > maxLen-len(suffix) {
+				base = base[:maxLen-len(suffix)]
+			}
+			name = string(base) + suffix
+		}
+		used[name] = true
+		names[h.id] = name
+	}
+	return names
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// jsonFormatVersion is increased whenever the JSON format changes in a way
+// that older readers cannot handle. Version 2 added code, keys, more styles,
+// admonitions and footnotes.
+const jsonFormatVersion = 2
+
+// jsonDocument is the JSON representation of a document. It is meant as a
+// stable interchange format for other tools.
+type jsonDocument struct {
+	Version int    `json:"version"`
+	Title   string `json:"title"`
+	// File is the name of the source file, if known
+	File  string     `json:"file,omitempty"`
+	Parts []jsonPart `json:"parts"`
+}
+
+// jsonPart is any docPart, Type tells which one. Only the fields that belong
+// to that type are set. The source range goes from Line and Column to EndLine
+// and EndColumn, which are all 1-indexed.
+type jsonPart struct {
+	Type      string `json:"type"`
+	Line      int    `json:"line,omitempty"`
+	Column    int    `json:"column,omitempty"`
+	EndLine   int    `json:"endLine,omitempty"`
+	EndColumn int    `json:"endColumn,omitempty"`
+	Text      string `json:"text,omitempty"`
+	ID        string `json:"id,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Bold      bool   `json:"bold,omitempty"`
+	Italic    bool   `json:"italic,omitempty"`
+	Underline bool   `json:"underline,omitempty"`
+	Strike    bool   `json:"strikethrough,omitempty"`
+	Super     bool   `json:"superscript,omitempty"`
+	Sub       bool   `json:"subscript,omitempty"`
+	Highlight bool   `json:"highlight,omitempty"`
+	// Kind is the kind of an admonition, Number is the number of a footnote
+	// and Parts is the content of both
+	Kind   string     `json:"kind,omitempty"`
+	Number int        `json:"number,omitempty"`
+	Parts  []jsonPart `json:"parts,omitempty"`
+}
+
+// styleFlags are the style flags of a jsonPart for each text style.
+func (j *jsonPart) styleFlags() []struct {
+	style textStyle
+	flag  *bool
+} {
+	return []struct {
+		style textStyle
+		flag  *bool
+	}{
+		{styleBold, &j.Bold},
+		{styleItalic, &j.Italic},
+		{styleUnderline, &j.Underline},
+		{styleStrike, &j.Strike},
+		{styleSuper, &j.Super},
+		{styleSub, &j.Sub},
+		{styleHighlight, &j.Highlight},
+	}
+}
+
+func (j *jsonPart) setStyle(style textStyle) {
+	for _, f := range j.styleFlags() {
+		*f.flag = style.has(f.style)
+	}
+}
+
+func (j *jsonPart) style() textStyle {
+	var style textStyle
+	for _, f := range j.styleFlags() {
+		if *f.flag {
+			style |= f.style
+		}
+	}
+	return style
+}
+
+// The type tags of the JSON parts.
+const (
+	jsonText           = "text"
+	jsonParagraphBreak = "paragraphBreak"
+	jsonLineBreak      = "lineBreak"
+	jsonTitle          = "title"
+	jsonCaption        = "caption"
+	jsonSubCaption     = "subCaption"
+	jsonSubSubCaption  = "subSubCaption"
+	jsonStyledText     = "styledText"
+	jsonImage          = "image"
+	jsonLink           = "link"
+	jsonExternalLink   = "externalLink"
+	jsonCode           = "code"
+	jsonKey            = "key"
+	jsonAdmonition     = "admonition"
+	jsonFootnote       = "footnote"
+)
+
+// jsonHeadingTypes are the type tags of the heading levels 1 to 4, see
+// headingOf.
+var jsonHeadingTypes = [...]string{jsonTitle, jsonCaption, jsonSubCaption, jsonSubSubCaption}
+
+// genJSON writes the document as JSON, see jsonDocument.
+func genJSON(doc document) ([]byte, error) {
+	parts, err := genJSONParts(doc)
+	if err != nil {
+		return nil, err
+	}
+	out := jsonDocument{
+		Version: jsonFormatVersion,
+		Title:   doc.title,
+		Parts:   parts,
+	}
+	doc.walk(func(_ docPart, pos sourceRange) {
+		if pos.file != "" {
+			out.File = pos.file
+		}
+	})
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// genJSONParts converts the parts of the document, the content of admonitions
+// and footnotes goes into their Parts.
+func genJSONParts(doc document) ([]jsonPart, error) {
+	parts := []jsonPart{}
+	for i, part := range doc.parts {
+		var j jsonPart
+		switch p := part.(type) {
+		case docText:
+			j = jsonPart{Type: jsonText, Text: string(p)}
+		case docParagraphBreak:
+			j = jsonPart{Type: jsonParagraphBreak}
+		case docLineBreak:
+			j = jsonPart{Type: jsonLineBreak}
+		case docImage:
+			j = jsonPart{Type: jsonImage, Name: p.name}
+		case docTitle, docCaption, docSubCaption, docSubSubCaption:
+			h, level, _ := headingOf(p)
+			j = jsonPart{Type: jsonHeadingTypes[level-1], Text: h.text, ID: h.id}
+		case docLink:
+			j = jsonPart{Type: jsonLink, ID: p.id, Text: p.text}
+			j.setStyle(p.style)
+		case externalDocLink:
+			j = jsonPart{Type: jsonExternalLink, URL: p.url, Text: p.text}
+			j.setStyle(p.style)
+		case stylizedDocText:
+			j = jsonPart{Type: jsonStyledText, Text: p.text}
+			j.setStyle(p.style)
+		case docCode:
+			j = jsonPart{Type: jsonCode, Text: string(p)}
+		case docKey:
+			j = jsonPart{Type: jsonKey, Text: string(p)}
+		case docAdmonition:
+			content, err := genJSONParts(p.content)
+			if err != nil {
+				return nil, err
+			}
+			j = jsonPart{Type: jsonAdmonition, Kind: string(p.kind), Parts: content}
+		case docFootnote:
+			content, err := genJSONParts(p.content)
+			if err != nil {
+				return nil, err
+			}
+			j = jsonPart{Type: jsonFootnote, Number: p.number, Parts: content}
+		default:
+			return nil, fmt.Errorf("error generating JSON: unhandled document part: %T", p)
+		}
+		pos := doc.position(i)
+		j.Line, j.Column = pos.start.line, pos.start.column
+		j.EndLine, j.EndColumn = pos.end.line, pos.end.column
+		parts = append(parts, j)
+	}
+	return parts, nil
+}
+
+// parseJSON reads a document that was written by genJSON. All links must
+// point to existing caption ids and footnotes must be numbered 1 to n in the
+// order of their references.
+func parseJSON(data []byte) (document, error) {
+	var in jsonDocument
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		return document{}, errors.New("invalid JSON document: " + err.Error())
+	}
+	if in.Version != jsonFormatVersion {
+		return document{}, fmt.Errorf("unsupported JSON document version %d, want %d", in.Version, jsonFormatVersion)
+	}
+
+	ids := make(map[string]bool)
+	doc, err := parseJSONParts(in.Parts, in.File, ids, "")
+	if err != nil {
+		return document{}, err
+	}
+	doc.title = in.Title
+
+	nextNumber := 1
+	for i, part := range doc.parts {
+		// links and footnotes in an admonition or footnote are reported at
+		// its index
+		var unknown []string
+		wrongNumber, wantNumber := false, 0
+		document{parts: []docPart{part}}.walk(func(part docPart, _ sourceRange) {
+			if link, ok := part.(docLink); ok && !ids[link.id] {
+				unknown = append(unknown, link.id)
+			}
+			if note, ok := part.(docFootnote); ok {
+				if note.number != nextNumber && !wrongNumber {
+					wrongNumber, wantNumber = true, nextNumber
+				}
+				nextNumber++
+			}
+		})
+		if len(unknown) > 0 {
+			return document{}, fmt.Errorf("JSON part %d links to unknown caption id '%s'", i, unknown[0])
+		}
+		if wrongNumber {
+			return document{}, fmt.Errorf(
+				"JSON part %d has a footnote with the wrong number, want %d, footnotes are numbered 1 to n in the order of their references",
+				i, wantNumber,
+			)
+		}
+	}
+	return doc, nil
+}
+
+// parseJSONParts converts the JSON parts into a document, it collects all
+// caption ids in ids. parent is the type of the part that contains the parts
+// or "" for the document. Captions and admonitions are only allowed in the
+// document, footnotes cannot be nested.
+func parseJSONParts(parts []jsonPart, file string, ids map[string]bool, parent string) (document, error) {
+	var doc document
+	for i, j := range parts {
+		var part docPart
+		switch j.Type {
+		case jsonText:
+			part = docText(j.Text)
+		case jsonParagraphBreak:
+			part = docParagraphBreak{}
+		case jsonLineBreak:
+			part = docLineBreak{}
+		case jsonTitle, jsonCaption, jsonSubCaption, jsonSubSubCaption:
+			if parent != "" {
+				return document{}, fmt.Errorf("JSON part %d is a caption inside a part of type '%s'", i, parent)
+			}
+			if !validID(j.ID) {
+				return document{}, fmt.Errorf("JSON part %d has an invalid caption id '%s'", i, j.ID)
+			}
+			if ids[j.ID] {
+				return document{}, fmt.Errorf("caption id '%s' is used more than once", j.ID)
+			}
+			ids[j.ID] = true
+			for level, t := range jsonHeadingTypes {
+				if t == j.Type {
+					part = withHeading(heading{text: j.Text, id: j.ID}, level+1)
+				}
+			}
+		case jsonStyledText:
+			part = stylizedDocText{text: j.Text, style: j.style()}
+		case jsonImage:
+			part = docImage{name: j.Name}
+		case jsonLink:
+			part = docLink{id: j.ID, text: j.Text, style: j.style()}
+		case jsonExternalLink:
+			part = externalDocLink{url: j.URL, text: j.Text, style: j.style()}
+		case jsonCode:
+			part = docCode(j.Text)
+		case jsonKey:
+			part = docKey(j.Text)
+		case jsonAdmonition:
+			if parent != "" {
+				return document{}, fmt.Errorf("JSON part %d is an admonition inside a part of type '%s'", i, parent)
+			}
+			kind, ok := findAdmonitionKind(j.Kind)
+			if !ok {
+				return document{}, fmt.Errorf("JSON part %d has unknown admonition kind '%s'", i, j.Kind)
+			}
+			content, err := parseJSONParts(j.Parts, file, ids, jsonAdmonition)
+			if err != nil {
+				return document{}, err
+			}
+			part = docAdmonition{kind: kind, content: content}
+		case jsonFootnote:
+			if parent == jsonFootnote {
+				return document{}, fmt.Errorf("JSON part %d is a footnote inside a footnote", i)
+			}
+			content, err := parseJSONParts(j.Parts, file, ids, jsonFootnote)
+			if err != nil {
+				return document{}, err
+			}
+			part = docFootnote{number: j.Number, content: content}
+		default:
+			return document{}, fmt.Errorf("JSON part %d has unknown type '%s'", i, j.Type)
+		}
+		doc.parts = append(doc.parts, part)
+		doc.positions = append(doc.positions, sourceRange{
+			file:  file,
+			start: sourcePos{line: j.Line, column: j.Column},
+			end:   sourcePos{line: j.EndLine, column: j.EndColumn},
+		})
+	}
+	return doc, nil
+}
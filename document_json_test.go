@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	doc, err := parse([]byte(`=====
+Title
+=====
+See [Two] and [www.example.com].[^n]
+Two {#second}
+===
+*bold* /italic/ */both/*\
+[image.png] ` + "`code`" + ` [key:F1]
+!!! tip
+See *[Two]*.[^m]
+!!!
+
+Sub
+---
+Sub sub
+.......
+
+[^n]: A *note* on [Two].
+[^m]: Another note.`))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	data, err := genJSON(doc)
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	back, err := parseJSON(data)
+	if err != nil {
+		t.Fatal("import error:", err)
+	}
+	if !reflect.DeepEqual(doc, back) {
+		t.Errorf("want\n%#v\nbut have\n%#v", doc, back)
+	}
+}
+
+func TestJSONHasTypesAndLines(t *testing.T) {
+	doc, err := parse([]byte(`Caption
+=======
+text
+[Caption]`))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	data, err := genJSON(doc)
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	want := `{
+  "version": 2,
+  "title": "",
+  "parts": [
+    {
+      "type": "caption",
+      "line": 1,
+      "column": 1,
+      "endLine": 1,
+      "endColumn": 8,
+      "text": "Caption",
+      "id": "caption"
+    },
+    {
+      "type": "text",
+      "line": 3,
+      "column": 1,
+      "endLine": 4,
+      "endColumn": 1,
+      "text": "text "
+    },
+    {
+      "type": "link",
+      "line": 4,
+      "column": 1,
+      "endLine": 4,
+      "endColumn": 10,
+      "text": "Caption",
+      "id": "caption"
+    }
+  ]
+}
+`
+	if string(data) != want {
+		t.Errorf("want\n%s\nbut have\n%s", want, data)
+	}
+}
+
+func TestJSONImportErrors(t *testing.T) {
+	for _, test := range []struct{ json, err string }{
+		{`{"version": 1, "parts": []}`, "unsupported JSON document version 1, want 2"},
+		{`{"version": 2, "parts": [{"type": "table"}]}`, "JSON part 0 has unknown type 'table'"},
+		{`{"version": 2, "parts": [{"type": "link", "id": "x"}]}`, "JSON part 0 links to unknown caption id 'x'"},
+		{`{"version": 2, "parts": [{"type": "caption", "id": "a b"}]}`, "JSON part 0 has an invalid caption id 'a b'"},
+		{`{"version": 2, "parts": [{"type": "caption", "id": "a"}, {"type": "subCaption", "id": "a"}]}`,
+			"caption id 'a' is used more than once"},
+		{`{"version": 2, "pages": []}`, "invalid JSON document"},
+		{`{"version": 2, "parts": [{"type": "footnote", "parts": [{"type": "text", "text": "a"}]}]}`,
+			"JSON part 0 has a footnote with the wrong number, want 1"},
+		{`{"version": 2, "parts": [{"type": "footnote", "number": 2, "parts": [{"type": "text", "text": "a"}]}]}`,
+			"JSON part 0 has a footnote with the wrong number, want 1"},
+		{`{"version": 2, "parts": [{"type": "footnote", "number": 1, "parts": [{"type": "text", "text": "a"}]},` +
+			` {"type": "text", "text": "b"}, {"type": "footnote", "number": 1, "parts": [{"type": "text", "text": "c"}]}]}`,
+			"JSON part 2 has a footnote with the wrong number, want 2"},
+	} {
+		_, err := parseJSON([]byte(test.json))
+		if err == nil {
+			t.Errorf("%s: error expected", test.json)
+		} else if !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%s: want error\n%s\nbut have\n%s", test.json, test.err, err)
+		}
+	}
+}
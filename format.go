@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// formatHelp normalizes the source of a help file. It trims trailing white
+// space, removes empty lines at the start and end and collapses multiple empty
+// lines into one, makes caption underlines as long as their captions and
+// removes escapes that are not necessary. The formatted code always produces
+// the same document as the original code. Formatting is idempotent.
+func formatHelp(code []byte) ([]byte, error) {
+	want, err := parse(code)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(string(unifyLineBreaks(code)), "\n")
+	var formatted []string
+	for _, line := range lines {
+		trimmed := strings.TrimRight(line, " \t")
+		if trimmed != line && computeLineKind([]byte(trimmed)) != textLine {
+			// the trailing space kept this from being an underline, escape
+			// its first character instead
+			trimmed = "[" + trimmed[:1] + "]" + trimmed[1:]
+		}
+		empty := trimmed == ""
+		if empty && (len(formatted) == 0 || formatted[len(formatted)-1] == "") {
+			continue
+		}
+		formatted = append(formatted, trimmed)
+	}
+	for len(formatted) > 0 && formatted[len(formatted)-1] == "" {
+		formatted = formatted[:len(formatted)-1]
+	}
+	formatUnderlines(formatted)
+	source := strings.Join(formatted, "\n") + "\n"
+
+	if !sameDocument(want, source) {
+		return nil, errors.New("formatting would change the document")
+	}
+	return []byte(removeEscapes(want, source)), nil
+}
+
+// formatUnderlines makes the lines above and below titles and the lines below
+// captions as long as the caption text, the same way that parseLines detects
+// captions.
+func formatUnderlines(lines []string) {
+	kind := func(i int) lineKind {
+		if i < 0 || i >= len(lines) {
+			return -1
+		}
+		return computeLineKind([]byte(lines[i]))
+	}
+	underline := func(i int, width int) {
+		if width < 3 {
+			width = 3
+		}
+		lines[i] = strings.Repeat(lines[i][:1], width)
+	}
+	for i, line := range lines {
+		if kind(i) != textLine || line == "" {
+			continue
+		}
+		below := kind(i + 1)
+		if below != equalsLine && below != minusLine && below != dottedLine {
+			continue
+		}
+		width := utf8.RuneCountInString(line)
+		underline(i+1, width)
+		isTitle := below == equalsLine && kind(i-1) == equalsLine &&
+			(i == 1 || kind(i-2) != textLine || lines[i-2] == "")
+		if isTitle {
+			underline(i-1, width)
+		}
+	}
+}
+
+// formatEscapes are the escapes of single characters and the characters that
+// they stand for.
+var formatEscapes = []struct{ escape, char string }{
+	{`[*]`, `*`},
+	{`[/]`, `/`},
+	{`[=]`, `=`},
+	{`[-]`, `-`},
+	{`[.]`, `.`},
+	{`[\]`, `\`},
+	{`[[]`, `[`},
+	{"[`]", "`"},
+	{`[_]`, `_`},
+	{`[~]`, `~`},
+	{`[^]`, `^`},
+	{`[!]`, `!`},
+}
+
+// removeEscapes replaces escapes with the characters they stand for wherever
+// the parser would not take these characters for markup, i.e. where the
+// document stays the same without the escape. The source is checked in blocks
+// of lines between empty lines, which are parsed on their own. Only blocks
+// with variable, footnote or admonition lines can change the rest of the
+// document, they are checked by parsing the whole source.
+func removeEscapes(doc document, source string) string {
+	var full parser
+	full.code = []byte(source)
+	full.parse()
+	if full.err != nil {
+		return source
+	}
+
+	lines := strings.Split(source, "\n")
+	for start := 0; start < len(lines); {
+		if lines[start] == "" {
+			start++
+			continue
+		}
+		end := start
+		for end < len(lines) && lines[end] != "" {
+			end++
+		}
+		block := lines[start:end]
+		want, local := parseBlock(block, start+1, &full)
+		for _, line := range block {
+			local = local && !affectsOtherBlocks(line)
+		}
+		sameWith := func(i int, line string) bool {
+			if startsAdmonition(line) && !startsAdmonition(block[i]) {
+				// an unknown kind is text, but lint would warn about it
+				return false
+			}
+			changed := append([]string(nil), block...)
+			changed[i] = line
+			if local && !affectsOtherBlocks(line) {
+				parts, ok := parseBlock(changed, start+1, &full)
+				return ok && reflect.DeepEqual(parts, want)
+			}
+			all := append(append(append([]string(nil), lines[:start]...), changed...), lines[end:]...)
+			return sameDocument(doc, strings.Join(all, "\n"))
+		}
+		removeBlockEscapes(block, sameWith)
+		start = end
+	}
+
+	formatted := strings.Join(lines, "\n")
+	if !sameDocument(doc, formatted) {
+		// this should not happen, keeping the escapes is always safe
+		return source
+	}
+	return formatted
+}
+
+// removeBlockEscapes removes the escapes from the lines of a block for which
+// sameWith returns true, i.e. where replacing line i does not change the
+// document. Removing one escape can make others unnecessary, so this is
+// repeated until nothing changes.
+func removeBlockEscapes(block []string, sameWith func(i int, line string) bool) {
+	for changed := true; changed; {
+		changed = false
+		for i := range block {
+			for _, e := range formatEscapes {
+				for start := 0; ; {
+					j := strings.Index(block[i][start:], e.escape)
+					if j == -1 {
+						break
+					}
+					j += start
+					candidate := block[i][:j] + e.char + block[i][j+len(e.escape):]
+					if sameWith(i, candidate) {
+						block[i] = candidate
+						changed = true
+						start = j + len(e.char)
+					} else {
+						start = j + len(e.escape)
+					}
+				}
+			}
+		}
+	}
+}
+
+// affectsOtherBlocks returns true for lines that define variables or
+// footnotes or start or end admonitions, which change how other blocks are
+// parsed.
+func affectsOtherBlocks(line string) bool {
+	_, _, isFootnote := footnoteDefinition([]byte(line))
+	return isFootnote ||
+		strings.HasPrefix(line, `[\`) ||
+		strings.HasPrefix(strings.TrimSpace(line), admonitionEnd)
+}
+
+// startsAdmonition returns true if the line looks like the start of an
+// admonition, even if its kind is unknown.
+func startsAdmonition(line string) bool {
+	_, name, _ := admonitionKindOf(codeLine{text: []byte(line)})
+	return name != ""
+}
+
+// parseBlock parses the lines of a block on their own, with the variables and
+// footnotes of the whole document. firstLine is the number of the block's
+// first line. It returns false if the block cannot be parsed on its own.
+func parseBlock(block []string, firstLine int, full *parser) ([]docPart, bool) {
+	p := parser{
+		code:  []byte(strings.Join(block, "\n")),
+		vars:  full.vars,
+		notes: make(map[string]*footnote),
+	}
+	// footnotes can only be referenced once, they are new for every block
+	for name, note := range full.notes {
+		p.notes[name] = &footnote{content: note.content, declLine: note.declLine}
+	}
+	lines := make([]codeLine, len(block))
+	for i, text := range block {
+		lines[i] = codeLine{
+			text:   []byte(text),
+			kind:   computeLineKind([]byte(text)),
+			number: firstLine + i,
+		}
+	}
+	p.parseLines(lines)
+	if p.err != nil {
+		return nil, false
+	}
+	simplifyDoc(&p.doc)
+	return withoutPositions(p.doc.parts), true
+}
+
+// sameDocument returns true if the source parses to the given document. The
+// source lines are not compared, formatting may remove empty lines.
+func sameDocument(doc document, source string) bool {
+	other, err := parse([]byte(source))
+	return err == nil &&
+		other.title == doc.title &&
+		reflect.DeepEqual(withoutPositions(other.parts), withoutPositions(doc.parts))
+}
+
+// withoutPositions returns the parts without the source positions inside
+// admonitions and footnotes, which change when formatting removes empty lines.
+func withoutPositions(parts []docPart) []docPart {
+	result := make([]docPart, len(parts))
+	for i, part := range parts {
+		switch p := part.(type) {
+		case docAdmonition:
+			p.content = document{parts: withoutPositions(p.content.parts)}
+			part = p
+		case docFootnote:
+			p.content = document{parts: withoutPositions(p.content.parts)}
+			part = p
+		}
+		result[i] = part
+	}
+	return result
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestFormatHelp(t *testing.T) {
+	for _, test := range []struct{ code, want string }{
+		{
+			"\n\n=\x3d=\nTitle  \n=========\n\n\n\ntext\t\nCaption\n===\nSub caption\n---\nLong sub sub caption\n...\n\n",
+			"=====\nTitle\n=====\n\ntext\nCaption\n=======\nSub caption\n-----------\nLong sub sub caption\n....................\n",
+		},
+		{
+			"A\n=======\nB\n=======\n",
+			"A\n===\nB\n===\n",
+		},
+		{
+			"a [*] b, 2[*]3, [/]path[/] and [[] x] [[]x] [\\] [-] [.]\n",
+			"a * b, 2*3, /path[/] and [ x] [[]x] \\ - .\n",
+		},
+		{
+			"*bold[*], text*, [*]not bold[*], trailing[\\]\nnext\n",
+			"*bold[*], text*, *not bold[*], trailing[\\]\nnext\n",
+		},
+		{
+			"[[]link]\n[Caption [*]]\n===\n",
+			"[[]link]\n[Caption [*]]\n=============\n",
+		},
+		{
+			"[-]--\n--- \n",
+			"[-]--\n[-]--\n",
+		},
+		{
+			"[\\v=a[*]b]\n\n[v] [*]x\n\na[^n] [/]\n\n[^n]: b [/] c\n",
+			"[\\v=a[*]b]\n\n[v] *x\n\na[^n] /\n\n[^n]: b / c\n",
+		},
+		{
+			"!!! Note\n\n\ntext  \n!!!\n[!]!! not [!]\n",
+			"!!! Note\n\ntext\n!!!\n[!]!! not !\n",
+		},
+	} {
+		got, err := formatHelp([]byte(test.code))
+		if err != nil {
+			t.Errorf("%q: got error: %s", test.code, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%q: want\n%q\nbut have\n%q", test.code, test.want, got)
+		}
+		again, err := formatHelp(got)
+		if err != nil || string(again) != string(got) {
+			t.Errorf("%q: formatting is not idempotent, second pass gives\n%q", test.code, again)
+		}
+	}
+}
+
+func TestFormatHelpNeedsValidCode(t *testing.T) {
+	_, err := formatHelp([]byte("[Unknown]"))
+	if err == nil {
+		t.Error("error expected")
+	}
+}
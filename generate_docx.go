@@ -0,0 +1,388 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image/png"
+	"strings"
+)
+
+const (
+	// docxMaxImageWidth is the width between the page margins in EMUs, English
+	// Metric Units, of which there are 914400 per inch
+	docxMaxImageWidth = 5731510
+	emusPerPixel      = 9525
+)
+
+// genDOCX creates an Office Open XML document. Captions use the Word styles
+// "heading 1" to "heading 4" and have bookmarks as link targets.
+func genDOCX(doc document) ([]byte, error) {
+	// the text of footnotes goes into notes, which becomes footnotes.xml,
+	// out is the one that is currently written
+	var body, notes bytes.Buffer
+	out := &body
+	write := func(s string) {
+		out.WriteString(s)
+	}
+
+	// relationships from the document to styles, hyperlinks, images and
+	// footnotes, the first one is the style sheet. The footnotes have
+	// relationships of their own for their hyperlinks and images, which are
+	// added while out is notes.
+	rels := []string{
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`,
+	}
+	var noteRels []string
+	addRel := func(relType, target, extra string) string {
+		r := &rels
+		if out == &notes {
+			r = &noteRels
+		}
+		id := fmt.Sprintf("rId%d", len(*r)+1)
+		*r = append(*r, fmt.Sprintf(
+			`<Relationship Id="%s" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/%s" Target="%s"%s/>`,
+			id, relType, xmlEscape(target), extra,
+		))
+		return id
+	}
+
+	type media struct {
+		name string
+		data []byte
+	}
+	var images []media
+	imageRels := make(map[string]string)
+	// drawingID numbers the drawings, Word needs unique ids even if an image
+	// is used more than once
+	drawingID := 0
+
+	// paragraphProps are the properties of the next paragraph
+	inParagraph := false
+	paragraphProps := ""
+	startParagraph := func() {
+		if !inParagraph {
+			write("<w:p>" + paragraphProps)
+		}
+		inParagraph = true
+	}
+	endParagraph := func() {
+		if inParagraph {
+			write("</w:p>")
+		}
+		inParagraph = false
+	}
+	bookmarks := bookmarkNames(doc)
+	bookmarkID := 0
+	writeCaption := func(cap heading, level int) {
+		endParagraph()
+		bookmarkID++
+		write(fmt.Sprintf(
+			`<w:p><w:pPr><w:pStyle w:val="Heading%d"/></w:pPr>`+
+				`<w:bookmarkStart w:id="%d" w:name="%s"/>%s<w:bookmarkEnd w:id="%d"/></w:p>`,
+			level, bookmarkID, bookmarks[cap.id], docxRun(cap.text, ""), bookmarkID,
+		))
+	}
+
+	// writeParts writes the parts of the document, it is called again for
+	// the content of admonitions and footnotes
+	var writeParts func(doc document) error
+	writeParts = func(doc document) error {
+		for i, part := range doc.parts {
+			switch part.(type) {
+			case docText, docImage, docLink, externalDocLink, stylizedDocText, docCode, docKey, docLineBreak, docFootnote:
+				startParagraph()
+			}
+
+			switch p := part.(type) {
+			case docText:
+				write(docxRun(string(p), ""))
+			case docParagraphBreak:
+				endParagraph()
+			case docLineBreak:
+				write("<w:r><w:br/></w:r>")
+			case docImage:
+				img, err := findImage(p.name)
+				if err != nil {
+					return doc.errorAt(i, fmt.Errorf("error generating DOCX image '%s': %s", p.name, err.Error()))
+				}
+				key := strings.ToLower(p.name)
+				if out == &notes {
+					key = "footnotes/" + key
+				}
+				rel, ok := imageRels[key]
+				if !ok {
+					var buf bytes.Buffer
+					if err := png.Encode(&buf, img); err != nil {
+						return fmt.Errorf("error encoding DOCX png '%s': %s", p.name, err.Error())
+					}
+					name := fmt.Sprintf("image%d.png", len(images)+1)
+					images = append(images, media{name: name, data: buf.Bytes()})
+					rel = addRel("image", "media/"+name, "")
+					imageRels[key] = rel
+				}
+				w := img.Bounds().Dx() * emusPerPixel
+				h := img.Bounds().Dy() * emusPerPixel
+				if w > docxMaxImageWidth {
+					h = int(float64(h) * docxMaxImageWidth / float64(w))
+					w = docxMaxImageWidth
+				}
+				drawingID++
+				write(docxImage(rel, drawingID, p.name, w, h))
+			case docTitle:
+				writeCaption(heading(p), 1)
+			case docCaption:
+				writeCaption(heading(p), 2)
+			case docSubCaption:
+				writeCaption(heading(p), 3)
+			case docSubSubCaption:
+				writeCaption(heading(p), 4)
+			case docLink:
+				write(`<w:hyperlink w:anchor="` + bookmarks[p.id] + `">`)
+				write(docxRun(p.text, `<w:rStyle w:val="Hyperlink"/>`+docxStyle(p.style)))
+				write(`</w:hyperlink>`)
+			case externalDocLink:
+				rel := addRel("hyperlink", p.url, ` TargetMode="External"`)
+				write(`<w:hyperlink r:id="` + rel + `">`)
+				write(docxRun(p.text, `<w:rStyle w:val="Hyperlink"/>`+docxStyle(p.style)))
+				write(`</w:hyperlink>`)
+			case stylizedDocText:
+				write(docxRun(p.text, docxStyle(p.style)))
+			case docCode:
+				write(docxRun(string(p), `<w:rStyle w:val="Code"/>`))
+			case docKey:
+				write(docxRun(string(p), `<w:rStyle w:val="Key"/>`))
+			case docFootnote:
+				// the footnote's text goes into footnotes.xml, Word numbers
+				// footnotes automatically
+				write(fmt.Sprintf(`<w:r><w:rPr><w:rStyle w:val="FootnoteReference"/></w:rPr><w:footnoteReference w:id="%d"/></w:r>`, p.number))
+				out = &notes
+				write(fmt.Sprintf(`<w:footnote w:id="%d"><w:p><w:pPr><w:pStyle w:val="FootnoteText"/></w:pPr>`, p.number))
+				write(`<w:r><w:rPr><w:rStyle w:val="FootnoteReference"/></w:rPr><w:footnoteRef/></w:r><w:r><w:t xml:space="preserve"> </w:t></w:r>`)
+				if err := writeParts(p.content); err != nil {
+					return err
+				}
+				write(`</w:p></w:footnote>`)
+				out = &body
+			case docAdmonition:
+				// all paragraphs of the admonition have its style, the first
+				// one is its title
+				endParagraph()
+				paragraphProps = `<w:pPr><w:pStyle w:val="` + docxAdmonitionStyle(p.kind) + `"/></w:pPr>`
+				startParagraph()
+				write(docxRun(p.kind.title(), "<w:b/>"))
+				endParagraph()
+				if err := writeParts(p.content); err != nil {
+					return err
+				}
+				endParagraph()
+				paragraphProps = ""
+			default:
+				return fmt.Errorf("error generating DOCX: unhandled document part: %T", p)
+			}
+		}
+		return nil
+	}
+	if err := writeParts(doc); err != nil {
+		return nil, err
+	}
+	endParagraph()
+
+	contentTypes := docxContentTypes
+	var footnoteFiles []struct{ name, content string }
+	if notes.Len() > 0 {
+		addRel("footnotes", "footnotes.xml", "")
+		contentTypes = strings.Replace(contentTypes, "</Types>", docxFootnotesContentType+"</Types>", 1)
+		footnoteFiles = []struct{ name, content string }{
+			{"word/_rels/footnotes.xml.rels", xmlHeader +
+				`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+				strings.Join(noteRels, "") + `</Relationships>`},
+			{"word/footnotes.xml", xmlHeader + `<w:footnotes` + docxNamespaces + `>` +
+				// Word needs the separator lines between text and footnotes
+				`<w:footnote w:type="separator" w:id="-1"><w:p><w:r><w:separator/></w:r></w:p></w:footnote>` +
+				`<w:footnote w:type="continuationSeparator" w:id="0"><w:p><w:r><w:continuationSeparator/></w:r></w:p></w:footnote>` +
+				notes.String() + `</w:footnotes>`},
+		}
+	}
+
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", contentTypes},
+		{"_rels/.rels", docxPackageRels},
+		{"docProps/core.xml", fmt.Sprintf(docxCoreProps, xmlEscape(doc.title))},
+		{"word/styles.xml", docxStyles},
+		{"word/_rels/document.xml.rels", xmlHeader +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			strings.Join(rels, "") + `</Relationships>`},
+		{"word/document.xml", xmlHeader +
+			`<w:document` + docxNamespaces + `>` +
+			`<w:body>` + body.String() +
+			// A4 with 1 inch margins
+			`<w:sectPr><w:pgSz w:w="11906" w:h="16838"/>` +
+			`<w:pgMar w:top="1440" w:right="1440" w:bottom="1440" w:left="1440" w:header="708" w:footer="708" w:gutter="0"/>` +
+			`</w:sectPr></w:body></w:document>`},
+	}
+	files = append(files, footnoteFiles...)
+	for _, file := range files {
+		w, err := z.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(file.content)); err != nil {
+			return nil, err
+		}
+	}
+	for _, img := range images {
+		w, err := z.CreateHeader(&zip.FileHeader{Name: "word/media/" + img.name, Method: zip.Store})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(img.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// docxRun creates a run of text with the given run properties.
+func docxRun(text, props string) string {
+	if props != "" {
+		props = "<w:rPr>" + props + "</w:rPr>"
+	}
+	lines := strings.Split(text, "\n")
+	for i := range lines {
+		lines[i] = `<w:t xml:space="preserve">` + xmlEscape(lines[i]) + `</w:t>`
+	}
+	return "<w:r>" + props + strings.Join(lines, "<w:br/>") + "</w:r>"
+}
+
+// docxImage creates an inline picture, width and height are given in EMUs.
+func docxImage(rel string, id int, name string, w, h int) string {
+	name = xmlEscape(name)
+	return fmt.Sprintf(`<w:r><w:drawing><wp:inline distT="0" distB="0" distL="0" distR="0">`+
+		`<wp:extent cx="%[3]d" cy="%[4]d"/><wp:docPr id="%[2]d" name="%[5]s"/>`+
+		`<a:graphic><a:graphicData uri="http://schemas.openxmlformats.org/drawingml/2006/picture">`+
+		`<pic:pic><pic:nvPicPr><pic:cNvPr id="%[2]d" name="%[5]s"/><pic:cNvPicPr/></pic:nvPicPr>`+
+		`<pic:blipFill><a:blip r:embed="%[1]s"/><a:stretch><a:fillRect/></a:stretch></pic:blipFill>`+
+		`<pic:spPr><a:xfrm><a:off x="0" y="0"/><a:ext cx="%[3]d" cy="%[4]d"/></a:xfrm>`+
+		`<a:prstGeom prst="rect"><a:avLst/></a:prstGeom></pic:spPr></pic:pic>`+
+		`</a:graphicData></a:graphic></wp:inline></w:drawing></w:r>`,
+		rel, id, w, h, name,
+	)
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// docxNamespaces are the namespaces of the document and footnotes parts.
+const docxNamespaces = ` xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"` +
+	` xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"` +
+	` xmlns:wp="http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing"` +
+	` xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main"` +
+	` xmlns:pic="http://schemas.openxmlformats.org/drawingml/2006/picture"`
+
+const xmlHeader = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n"
+
+const docxContentTypes = xmlHeader + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+	`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+	`<Default Extension="xml" ContentType="application/xml"/>` +
+	`<Default Extension="png" ContentType="image/png"/>` +
+	`<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>` +
+	`<Override PartName="/word/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.styles+xml"/>` +
+	`<Override PartName="/docProps/core.xml" ContentType="application/vnd.openxmlformats-package.core-properties+xml"/>` +
+	`</Types>`
+
+const docxFootnotesContentType = `<Override PartName="/word/footnotes.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.footnotes+xml"/>`
+
+const docxPackageRels = xmlHeader + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>` +
+	`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/package/2006/relationships/metadata/core-properties" Target="docProps/core.xml"/>` +
+	`</Relationships>`
+
+const docxCoreProps = xmlHeader + `<cp:coreProperties` +
+	` xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties"` +
+	` xmlns:dc="http://purl.org/dc/elements/1.1/">` +
+	`<dc:title>%s</dc:title></cp:coreProperties>`
+
+// docxStyleProps are the run properties of the text styles, in the order that
+// the schema requires.
+var docxStyleProps = []struct {
+	style textStyle
+	prop  string
+}{
+	{styleBold, "<w:b/>"},
+	{styleItalic, "<w:i/>"},
+	{styleStrike, "<w:strike/>"},
+	{styleHighlight, `<w:highlight w:val="yellow"/>`},
+	{styleUnderline, `<w:u w:val="single"/>`},
+	{styleSuper, `<w:vertAlign w:val="superscript"/>`},
+	{styleSub, `<w:vertAlign w:val="subscript"/>`},
+}
+
+// docxStyle returns the run properties of the style.
+func docxStyle(style textStyle) string {
+	var props string
+	for _, s := range docxStyleProps {
+		if style.has(s.style) {
+			props += s.prop
+		}
+	}
+	return props
+}
+
+// docxAdmonitionStyle returns the id of the paragraph style of the admonition,
+// e.g. "Warning".
+func docxAdmonitionStyle(kind admonitionKind) string {
+	return kind.title()
+}
+
+// docxStyles has the same heading styles as the RTF style sheet, the sizes are
+// in half-points.
+var docxStyles = xmlHeader + `<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">` +
+	`<w:docDefaults><w:rPrDefault><w:rPr><w:rFonts w:ascii="Calibri" w:hAnsi="Calibri" w:cs="Calibri"/>` +
+	`<w:sz w:val="22"/></w:rPr></w:rPrDefault>` +
+	`<w:pPrDefault><w:pPr><w:spacing w:after="120"/></w:pPr></w:pPrDefault></w:docDefaults>` +
+	`<w:style w:type="paragraph" w:default="1" w:styleId="Normal"><w:name w:val="Normal"/><w:qFormat/></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="Heading1"><w:name w:val="heading 1"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/>` +
+	`<w:pPr><w:keepNext/><w:spacing w:before="240" w:after="60"/><w:outlineLvl w:val="0"/></w:pPr><w:rPr><w:b/><w:sz w:val="45"/></w:rPr></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="Heading2"><w:name w:val="heading 2"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/>` +
+	`<w:pPr><w:keepNext/><w:spacing w:before="240" w:after="60"/><w:outlineLvl w:val="1"/></w:pPr><w:rPr><w:b/><w:sz w:val="40"/></w:rPr></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="Heading3"><w:name w:val="heading 3"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/>` +
+	`<w:pPr><w:keepNext/><w:spacing w:before="240" w:after="60"/><w:outlineLvl w:val="2"/></w:pPr><w:rPr><w:b/><w:sz w:val="34"/></w:rPr></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="Heading4"><w:name w:val="heading 4"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/>` +
+	`<w:pPr><w:keepNext/><w:spacing w:before="240" w:after="60"/><w:outlineLvl w:val="3"/></w:pPr><w:rPr><w:b/><w:sz w:val="22"/></w:rPr></w:style>` +
+	`<w:style w:type="character" w:styleId="Hyperlink"><w:name w:val="Hyperlink"/><w:rPr><w:color w:val="0563C1"/><w:u w:val="single"/></w:rPr></w:style>` +
+	`<w:style w:type="character" w:styleId="Code"><w:name w:val="Code"/><w:rPr><w:rFonts w:ascii="Consolas" w:hAnsi="Consolas" w:cs="Consolas"/></w:rPr></w:style>` +
+	`<w:style w:type="character" w:styleId="Key"><w:name w:val="Key"/><w:basedOn w:val="Code"/>` +
+	`<w:rPr><w:bdr w:val="single" w:sz="4" w:space="1" w:color="808080"/><w:sz w:val="20"/></w:rPr></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="FootnoteText"><w:name w:val="footnote text"/><w:basedOn w:val="Normal"/>` +
+	`<w:pPr><w:spacing w:after="0"/></w:pPr><w:rPr><w:sz w:val="18"/></w:rPr></w:style>` +
+	`<w:style w:type="character" w:styleId="FootnoteReference"><w:name w:val="footnote reference"/><w:rPr><w:vertAlign w:val="superscript"/></w:rPr></w:style>` +
+	docxAdmonitionStyles() +
+	`</w:styles>`
+
+// docxAdmonitionStyles defines the paragraph styles of the admonitions. Their
+// paragraphs are indented and shaded and have a thick border on the left,
+// like in RTF.
+func docxAdmonitionStyles() string {
+	var styles string
+	for _, c := range rtfAdmonitionColors {
+		styles += fmt.Sprintf(`<w:style w:type="paragraph" w:styleId="%s"><w:name w:val="%s"/><w:basedOn w:val="Normal"/>`+
+			`<w:pPr><w:pBdr><w:left w:val="single" w:sz="24" w:space="6" w:color="%s"/></w:pBdr>`+
+			`<w:shd w:val="clear" w:color="auto" w:fill="%s"/><w:ind w:left="240" w:right="240"/></w:pPr></w:style>`,
+			docxAdmonitionStyle(c.kind), c.kind.title(), c.border.hex(), c.background.hex(),
+		)
+	}
+	return styles
+}
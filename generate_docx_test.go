@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDOCXPackage(t *testing.T) {
+	files := genTestDOCX(t, `=====
+Title
+=====
+See [Two] and [the web[https://example.com/?a=1&b=2]].
+Two
+===
+*bold* and /italic/ text.`)
+
+	for _, name := range []string{
+		"[Content_Types].xml",
+		"_rels/.rels",
+		"docProps/core.xml",
+		"word/document.xml",
+		"word/styles.xml",
+		"word/_rels/document.xml.rels",
+	} {
+		content, ok := files[name]
+		if !ok {
+			t.Errorf("missing file %s", name)
+		}
+		checkWellFormedXML(t, name, content)
+	}
+	for _, check := range []struct{ file, want string }{
+		{"word/document.xml", `<w:pStyle w:val="Heading1"/></w:pPr><w:bookmarkStart w:id="1" w:name="_title"/>`},
+		{"word/document.xml", `<w:hyperlink w:anchor="_two"><w:r><w:rPr><w:rStyle w:val="Hyperlink"/></w:rPr>` +
+			`<w:t xml:space="preserve">Two</w:t></w:r></w:hyperlink>`},
+		{"word/document.xml", `<w:hyperlink r:id="rId2">`},
+		{"word/document.xml", `<w:r><w:rPr><w:b/></w:rPr><w:t xml:space="preserve">bold</w:t></w:r>`},
+		{"word/document.xml", `<w:r><w:rPr><w:i/></w:rPr><w:t xml:space="preserve">italic</w:t></w:r>`},
+		{"word/_rels/document.xml.rels", `Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/hyperlink"` +
+			` Target="https://example.com/?a=1&amp;b=2" TargetMode="External"`},
+		{"docProps/core.xml", `<dc:title>Title</dc:title>`},
+	} {
+		if !strings.Contains(files[check.file], check.want) {
+			t.Errorf("%s does not contain\n%s\n%s", check.file, check.want, files[check.file])
+		}
+	}
+}
+
+func TestDOCXParagraphs(t *testing.T) {
+	files := genTestDOCX(t, `one\
+two
+
+three`)
+	want := `<w:body><w:p><w:r><w:t xml:space="preserve">one</w:t></w:r><w:r><w:br/></w:r>` +
+		`<w:r><w:t xml:space="preserve">two</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t xml:space="preserve">three</w:t></w:r></w:p><w:sectPr>`
+	if !strings.Contains(files["word/document.xml"], want) {
+		t.Errorf("want\n%s\nin\n%s", want, files["word/document.xml"])
+	}
+}
+
+func TestDOCXDrawingsHaveUniqueIDs(t *testing.T) {
+	imageCache["a.png"] = image.NewRGBA(image.Rect(0, 0, 2, 2))
+	imageCache["b.png"] = image.NewRGBA(image.Rect(0, 0, 2, 2))
+	defer delete(imageCache, "a.png")
+	defer delete(imageCache, "b.png")
+	doc := genTestDOCX(t, "[a.png][b.png][a.png]")["word/document.xml"]
+	for _, want := range []string{`<wp:docPr id="1"`, `<wp:docPr id="2"`, `<wp:docPr id="3"`} {
+		if strings.Count(doc, want) != 1 {
+			t.Errorf("want one %s in\n%s", want, doc)
+		}
+	}
+	if n := strings.Count(doc, `r:embed="rId2"`); n != 2 {
+		t.Errorf("image a must be used twice but is used %d times", n)
+	}
+}
+
+func TestBookmarkNamesAreUniqueAndShort(t *testing.T) {
+	long := strings.Repeat("x", 50)
+	names := bookmarkNames(document{parts: []docPart{
+		docCaption{id: "a-b"},
+		docCaption{id: "a_b"},
+		docCaption{id: "a.b"},
+		docCaption{id: "größe"},
+		docCaption{id: "grüße"},
+		docCaption{id: long},
+		docCaption{id: long + "y"},
+	}})
+	want := map[string]string{
+		"a-b":      "_a_b",
+		"a_b":      "_a_b_2",
+		"a.b":      "_a_b_3",
+		"größe":    "_gr__e",
+		"grüße":    "_gr__e_2",
+		long:       "_" + long[:39],
+		long + "y": "_" + long[:37] + "_2",
+	}
+	for id, name := range want {
+		if names[id] != name {
+			t.Errorf("want bookmark name %s for id %s but have %s", name, id, names[id])
+		}
+	}
+}
+
+func genTestDOCX(t *testing.T, code string) map[string]string {
+	t.Helper()
+	doc, err := parse([]byte(code))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	docx, err := genDOCX(doc)
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(docx), int64(len(docx)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(data)
+	}
+	return files
+}
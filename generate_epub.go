@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"html"
+	"image"
+	"image/png"
+	"strings"
+	"time"
+)
+
+// epubOptions are the HTML options for the style sheet and language and the
+// modification date of the book.
+type epubOptions struct {
+	htmlOptions
+	// modified is the date of the last change, now if it is zero. A fixed
+	// date makes the output reproducible.
+	modified time.Time
+}
+
+func genEPUB(doc document) ([]byte, error) {
+	return genEPUBWithOptions(doc, epubOptions{htmlOptions: htmlOptions{
+		theme: defaultHTMLTheme,
+		lang:  defaultHTMLLang,
+	}})
+}
+
+// genEPUBWithOptions creates an EPUB 3 e-book. Every caption starts a new
+// chapter file, the text before the first caption goes into a chapter of its
+// own. The style sheet is created from the HTML theme and custom CSS.
+func genEPUBWithOptions(doc document, opts epubOptions) ([]byte, error) {
+	theme, err := findHTMLTheme(opts.theme)
+	if err != nil {
+		return nil, err
+	}
+	lang := opts.lang
+	if lang == "" {
+		lang = defaultHTMLLang
+	}
+	title := doc.title
+	if title == "" {
+		title = "Help"
+	}
+
+	// split the document into chapters and remember in which chapter each
+	// caption id is, for links between chapters
+	var chapters []document
+	chapterOf := make(map[string]int)
+	for i, part := range doc.parts {
+		_, isCaption := part.(docCaption)
+		if len(chapters) == 0 || isCaption && len(chapters[len(chapters)-1].parts) > 0 {
+			chapters = append(chapters, document{})
+		}
+		last := &chapters[len(chapters)-1]
+		last.parts = append(last.parts, part)
+		last.positions = append(last.positions, doc.position(i))
+		if h, _, ok := headingOf(part); ok {
+			chapterOf[h.id] = len(chapters) - 1
+		}
+	}
+	if len(chapters) == 0 {
+		chapters = append(chapters, document{})
+	}
+	chapterFile := func(i int) string {
+		return fmt.Sprintf("chapter%d.xhtml", i+1)
+	}
+	href := func(id string) string {
+		return chapterFile(chapterOf[id]) + "#" + id
+	}
+
+	type epubImage struct {
+		file string
+		data []byte
+	}
+	var images []epubImage
+	imageFiles := make(map[string]string)
+	body := htmlBodyWriter{
+		xhtml: true,
+		href:  href,
+		imageSrc: func(name string, img image.Image) (string, error) {
+			key := strings.ToLower(name)
+			if file, ok := imageFiles[key]; ok {
+				return file, nil
+			}
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, img); err != nil {
+				return "", err
+			}
+			file := fmt.Sprintf("images/image%d.png", len(images)+1)
+			images = append(images, epubImage{file: file, data: buf.Bytes()})
+			imageFiles[key] = file
+			return file, nil
+		},
+	}
+
+	modified := opts.modified
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	// the mimetype must be the first file and it must not be compressed
+	mimetype, err := z.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := mimetype.Write([]byte("application/epub+zip")); err != nil {
+		return nil, err
+	}
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"META-INF/container.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+<rootfiles>
+<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+</rootfiles>
+</container>
+`},
+		{"OEBPS/style.css", theme + opts.css},
+	}
+
+	var manifest, spine bytes.Buffer
+	for i, chapter := range chapters {
+		content, err := genHTMLBody(chapter, body)
+		if err != nil {
+			return nil, err
+		}
+		chapterTitle := title
+		if len(chapter.parts) > 0 {
+			if h, _, ok := headingOf(chapter.parts[0]); ok {
+				chapterTitle = h.text
+			}
+		}
+		files = append(files, struct{ name, content string }{
+			"OEBPS/" + chapterFile(i),
+			xhtmlPage(lang, chapterTitle, content),
+		})
+		fmt.Fprintf(&manifest, `<item id="chapter%d" href="%s" media-type="application/xhtml+xml"/>`+"\n", i+1, chapterFile(i))
+		fmt.Fprintf(&spine, `<itemref idref="chapter%d"/>`+"\n", i+1)
+	}
+
+	toc := genHTMLTOC(doc.parts, "ol", href)
+	if toc == "" {
+		toc = `<ol><li><a href="` + chapterFile(0) + `">` + escapeHTML(title) + `</a></li></ol>`
+	}
+	toc = strings.Replace(toc, "&nbsp;", "&#160;", -1)
+	files = append(files, struct{ name, content string }{
+		"OEBPS/nav.xhtml",
+		xhtmlPage(lang, title, `<nav epub:type="toc" id="toc"><h1>`+html.EscapeString(title)+`</h1>`+toc+`</nav>`),
+	})
+
+	for i, img := range images {
+		fmt.Fprintf(&manifest, `<item id="image%d" href="%s" media-type="image/png"/>`+"\n", i+1, img.file)
+	}
+	files = append(files, struct{ name, content string }{
+		"OEBPS/content.opf",
+		fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid" xml:lang="%s">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:identifier id="uid">%s</dc:identifier>
+<dc:title>%s</dc:title>
+<dc:language>%s</dc:language>
+<meta property="dcterms:modified">%s</meta>
+</metadata>
+<manifest>
+<item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+<item id="style" href="style.css" media-type="text/css"/>
+%s</manifest>
+<spine>
+%s</spine>
+</package>
+`,
+			html.EscapeString(lang),
+			epubIdentifier(doc),
+			html.EscapeString(title),
+			html.EscapeString(lang),
+			modified.UTC().Format("2006-01-02T15:04:05Z"),
+			manifest.String(),
+			spine.String(),
+		),
+	})
+
+	for _, file := range files {
+		w, err := z.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(file.content)); err != nil {
+			return nil, err
+		}
+	}
+	for _, img := range images {
+		// PNGs are already compressed
+		w, err := z.CreateHeader(&zip.FileHeader{Name: "OEBPS/" + img.file, Method: zip.Store})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(img.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func xhtmlPage(lang, title, body string) string {
+	lang = html.EscapeString(lang)
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="` + lang + `" xml:lang="` + lang + `">
+<head>
+<meta charset="UTF-8"/>
+<title>` + html.EscapeString(title) + `</title>
+<link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>` + body + `</body>
+</html>
+`
+}
+
+// epubIdentifier creates a UUID from the document's title and captions, so
+// the identifier stays the same when the book is generated again.
+func epubIdentifier(doc document) string {
+	h := sha1.New()
+	h.Write([]byte(doc.title))
+	for _, part := range doc.parts {
+		if heading, _, ok := headingOf(part); ok {
+			h.Write([]byte("\n" + heading.text))
+		}
+	}
+	u := h.Sum(nil)[:16]
+	u[6] = u[6]&0x0F | 0x50 // version 5, name based with SHA-1
+	u[8] = u[8]&0x3F | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEPUBContainer(t *testing.T) {
+	files := genTestEPUB(t, `=====
+Title
+=====
+Intro with a [link[Two]].
+One
+===
+Text & more  text.
+One.One
+-------
+Two
+===
+[Title]`)
+
+	for _, name := range []string{
+		"META-INF/container.xml",
+		"OEBPS/content.opf",
+		"OEBPS/nav.xhtml",
+		"OEBPS/style.css",
+		"OEBPS/chapter1.xhtml",
+		"OEBPS/chapter2.xhtml",
+		"OEBPS/chapter3.xhtml",
+	} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("missing file %s", name)
+		}
+	}
+	if _, ok := files["OEBPS/chapter4.xhtml"]; ok {
+		t.Error("there must only be three chapters")
+	}
+	for name, content := range files {
+		if strings.HasSuffix(name, ".xhtml") || strings.HasSuffix(name, ".xml") || strings.HasSuffix(name, ".opf") {
+			checkWellFormedXML(t, name, content)
+		}
+	}
+	for file, want := range map[string]string{
+		"OEBPS/chapter1.xhtml": `<a href="chapter3.xhtml#two">link</a>`,
+		"OEBPS/chapter2.xhtml": `<h3 id="one-one">One.One</h3>`,
+		"OEBPS/chapter3.xhtml": `<a href="chapter1.xhtml#title">Title</a>`,
+		"OEBPS/nav.xhtml":      `<ol><li><a href="chapter2.xhtml#one">One</a><ol><li><a href="chapter2.xhtml#one-one">`,
+		"OEBPS/content.opf":    `<itemref idref="chapter3"/>`,
+	} {
+		if !strings.Contains(files[file], want) {
+			t.Errorf("%s does not contain\n%s\n%s", file, want, files[file])
+		}
+	}
+	if !strings.Contains(files["OEBPS/chapter2.xhtml"], "Text &amp; more&#160;&#160;text.") {
+		t.Errorf("XHTML must not use &nbsp;\n%s", files["OEBPS/chapter2.xhtml"])
+	}
+}
+
+func TestEPUBNavStartsAtTheFirstHeading(t *testing.T) {
+	files := genTestEPUB(t, `Sub
+---
+Caption
+=======
+Sub sub
+.......`)
+	want := `<ol><li><a href="chapter1.xhtml#sub">Sub</a></li>` +
+		`<li><a href="chapter2.xhtml#caption">Caption</a>` +
+		`<ol><li><a href="chapter2.xhtml#sub-sub">Sub sub</a></li></ol></li></ol>`
+	if !strings.Contains(files["OEBPS/nav.xhtml"], want) {
+		t.Errorf("want nav\n%s\nbut have\n%s", want, files["OEBPS/nav.xhtml"])
+	}
+}
+
+func TestEPUBModificationDateCanBeFixed(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var books [][]byte
+	for i := 0; i < 2; i++ {
+		epub, err := genEPUBWithOptions(document{parts: []docPart{docText("text")}}, epubOptions{
+			htmlOptions: htmlOptions{theme: defaultHTMLTheme},
+			modified:    modified,
+		})
+		if err != nil {
+			t.Fatal("got error:", err)
+		}
+		books = append(books, epub)
+	}
+	if !bytes.Equal(books[0], books[1]) {
+		t.Error("books with a fixed date must be equal")
+	}
+	opf := epubFiles(t, books[0])["OEBPS/content.opf"]
+	if !strings.Contains(opf, `<meta property="dcterms:modified">2024-05-01T12:00:00Z</meta>`) {
+		t.Errorf("the fixed date is missing:\n%s", opf)
+	}
+}
+
+func genTestEPUB(t *testing.T, code string) map[string]string {
+	t.Helper()
+	doc, err := parse([]byte(code))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	epub, err := genEPUB(doc)
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	return epubFiles(t, epub)
+}
+
+func epubFiles(t *testing.T, epub []byte) map[string]string {
+	t.Helper()
+	z, err := zip.NewReader(bytes.NewReader(epub), int64(len(epub)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if z.File[0].Name != "mimetype" || z.File[0].Method != zip.Store {
+		t.Fatal("the first file must be the uncompressed mimetype")
+	}
+	files := make(map[string]string)
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(data)
+	}
+	if files["mimetype"] != "application/epub+zip" {
+		t.Errorf("wrong mimetype %q", files["mimetype"])
+	}
+	return files
+}
+
+func checkWellFormedXML(t *testing.T, name, content string) {
+	t.Helper()
+	d := xml.NewDecoder(strings.NewReader(content))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Errorf("%s is not well-formed XML: %s", name, err)
+			return
+		}
+	}
+}
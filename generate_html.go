@@ -6,87 +6,342 @@ import (
 	"errors"
 	"fmt"
 	"html"
+	"html/template"
 	"image"
 	"image/png"
 	"strings"
 )
 
+// htmlOptions control the look of the generated HTML page.
+type htmlOptions struct {
+	// theme is the name of one of the htmlThemes.
+	theme string
+	// css is a custom style sheet that is inlined after the theme's styles.
+	css string
+	// lang is the language of the document, e.g. "en" or "de-AT".
+	lang string
+	// template, if not nil, replaces the default page layout. It is executed
+	// with an htmlPage as its data.
+	template *template.Template
+}
+
+// htmlPage is the data passed to HTML page templates.
+type htmlPage struct {
+	Title string
+	Lang  string
+	CSS   template.CSS
+	TOC   template.HTML
+	Body  template.HTML
+}
+
+const defaultHTMLLang = "en"
+
+var defaultHTMLTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="UTF-8">
+<title>{{if .Title}}{{.Title}}{{else}}Help{{end}}</title>
+<style>
+{{.CSS}}</style>
+</head>
+<body>{{.Body}}</body>
+</html>
+`))
+
 func genHTML(doc document) ([]byte, error) {
+	return genHTMLWithOptions(doc, htmlOptions{
+		theme: defaultHTMLTheme,
+		lang:  defaultHTMLLang,
+	})
+}
+
+func genHTMLWithOptions(doc document, opts htmlOptions) ([]byte, error) {
+	theme, err := findHTMLTheme(opts.theme)
+	if err != nil {
+		return nil, err
+	}
+	body, err := genHTMLBody(doc, htmlPageBody)
+	if err != nil {
+		return nil, err
+	}
+	lang := opts.lang
+	if lang == "" {
+		lang = defaultHTMLLang
+	}
+	page := htmlPage{
+		Title: doc.title,
+		Lang:  lang,
+		CSS:   template.CSS(theme + opts.css),
+		TOC:   template.HTML(genHTMLTOC(doc.parts, "ul", htmlPageBody.href)),
+		Body:  template.HTML(body),
+	}
+	tmpl := opts.template
+	if tmpl == nil {
+		tmpl = defaultHTMLTemplate
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, page); err != nil {
+		return nil, errors.New("error executing HTML template: " + err.Error())
+	}
+	return buf.Bytes(), nil
+}
+
+// htmlBodyWriter configures genHTMLBody for the different outputs that are
+// based on HTML.
+type htmlBodyWriter struct {
+	// xhtml makes the output well-formed XML
+	xhtml bool
+	// href returns the link to the caption with the given id
+	href func(id string) string
+	// imageSrc returns the src attribute for an image
+	imageSrc func(name string, img image.Image) (string, error)
+}
+
+// htmlPageBody writes a body for a single HTML page, all links go to the same
+// page and images are inlined as data URIs.
+var htmlPageBody = htmlBodyWriter{
+	href: func(id string) string {
+		return "#" + id
+	},
+	imageSrc: func(_ string, img image.Image) (string, error) {
+		return imageDataURI(img)
+	},
+}
+
+// genHTMLBody generates the contents of the HTML <body> element. All text,
+// links and images are placed in paragraphs. The footnotes are listed at the
+// end, with links back to their references.
+func genHTMLBody(doc document, w htmlBodyWriter) (string, error) {
+	var notes []docFootnote
+	body, err := genHTMLParts(doc, w, &notes)
+	if err != nil || len(notes) == 0 {
+		return body, err
+	}
+	hr := "<hr>"
+	if w.xhtml {
+		hr = "<hr/>"
+	}
+	body += `<section class="footnotes">` + hr + "<ol>"
+	for _, note := range notes {
+		content, err := genHTMLParts(note.content, w, &notes)
+		if err != nil {
+			return "", err
+		}
+		back := fmt.Sprintf(` <a class="footnote-back" href="#%s">↩</a>`, htmlFootnoteRefID(note.number))
+		content = strings.TrimSuffix(content, "</p>") + back + "</p>"
+		body += fmt.Sprintf(`<li id="%s" value="%d">%s</li>`, htmlFootnoteID(note.number), note.number, content)
+	}
+	return body + "</ol></section>", nil
+}
+
+// htmlFootnoteID is the id of the footnote in the list of footnotes,
+// htmlFootnoteRefID is the id of its reference. Caption ids cannot contain
+// ':' so they do not collide.
+func htmlFootnoteID(number int) string {
+	return fmt.Sprintf("fn:%d", number)
+}
+
+func htmlFootnoteRefID(number int) string {
+	return fmt.Sprintf("fnref:%d", number)
+}
+
+// genHTMLParts generates the HTML of the parts, see genHTMLBody. The footnotes
+// are appended to notes.
+func genHTMLParts(doc document, w htmlBodyWriter, notes *[]docFootnote) (string, error) {
 	var buf bytes.Buffer
 	write := func(s string) {
 		buf.WriteString(s)
 	}
-	writeCaption := func(cap, size string) {
-		write("<h" + size + ">" + escapeHTML(cap) + "</h" + size + ">")
+	escape := func(s string) string {
+		s = escapeHTML(s)
+		if w.xhtml {
+			// XML does not know the &nbsp; entity
+			s = strings.Replace(s, "&nbsp;", "&#160;", -1)
+		}
+		return s
+	}
+	voidEnd := ">"
+	if w.xhtml {
+		voidEnd = "/>"
 	}
 
-	write(`<!DOCTYPE html><meta charset="UTF-8"><html><head>
-<style>
- body{
-  background-color: #D7EEEF;
-  text-align: left;
-  max-width:800px;
-  margin-left: auto;
-  margin-right: auto;
- }
-</style>`)
-	if doc.title != "" {
-		write(`<title>` + doc.title + `</title>`)
-	}
-	write(`</head><body>`)
-	for _, part := range doc.parts {
+	// inParagraph is true while a <p> is open, lineBreak is true if the next
+	// inline content has to go on a new line, a <br> at the end of a
+	// paragraph would be useless
+	inParagraph, lineBreak := false, false
+	endParagraph := func() {
+		if inParagraph {
+			write("</p>")
+		}
+		inParagraph, lineBreak = false, false
+	}
+	writeInline := func(s string) {
+		if !inParagraph {
+			write("<p>")
+			inParagraph = true
+		}
+		if lineBreak {
+			write("<br" + voidEnd)
+			lineBreak = false
+		}
+		write(s)
+	}
+	writeCaption := func(cap heading, size string) {
+		endParagraph()
+		write(fmt.Sprintf(`<h%s id="%s">%s</h%s>`, size, html.EscapeString(cap.id), escape(cap.text), size))
+	}
+
+	for i, part := range doc.parts {
 		switch p := part.(type) {
 		case docText:
-			lines := strings.Split(string(p), "\n")
-			for i := range lines {
-				lines[i] = escapeHTML(lines[i])
+			writeInline(escape(string(p)))
+		case docLineBreak:
+			if inParagraph {
+				lineBreak = true
 			}
-			write(strings.Join(lines, "<br>"))
+		case docParagraphBreak:
+			endParagraph()
 		case docImage:
 			img, err := findImage(p.name)
 			if err != nil {
-				return nil, fmt.Errorf("error generating HTML image '%s': %s", p.name, err.Error())
+				return "", doc.errorAt(i, fmt.Errorf("error generating HTML image '%s': %s", p.name, err.Error()))
 			}
-			tag, err := imageTag(img)
+			src, err := w.imageSrc(p.name, img)
 			if err != nil {
-				return nil, fmt.Errorf("error generating HTML image tag for '%s': %s", p.name, err.Error())
+				return "", doc.errorAt(i, fmt.Errorf("error generating HTML image tag for '%s': %s", p.name, err.Error()))
 			}
-			write(tag)
+			writeInline(`<img src="` + html.EscapeString(src) + `" alt="` + html.EscapeString(p.name) + `"` + voidEnd)
 		case docTitle:
-			writeCaption(string(p), "1")
+			writeCaption(heading(p), "1")
 		case docCaption:
-			writeCaption(string(p), "2")
+			writeCaption(heading(p), "2")
 		case docSubCaption:
-			writeCaption(string(p), "3")
+			writeCaption(heading(p), "3")
 		case docSubSubCaption:
-			writeCaption(string(p), "4")
+			writeCaption(heading(p), "4")
 		case docLink:
-			write(fmt.Sprintf(`<a href="#%d">%s</a>`, p.id, escapeHTML(p.text)))
-		case docLinkTarget:
-			write(fmt.Sprintf(`<a id="%d"/>`, int(p)))
+			writeInline(fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(w.href(p.id)), htmlStyled(escape(p.text), p.style)))
 		case externalDocLink:
-			write(fmt.Sprintf(`<a href="%s">%s</a>`, p.url, escapeHTML(p.text)))
+			writeInline(fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(p.url), htmlStyled(escape(p.text), p.style)))
 		case stylizedDocText:
-			if p.bold {
-				write("<b>")
-			}
-			if p.italic {
-				write("<i>")
+			writeInline(htmlStyled(escape(p.text), p.style))
+		case docCode:
+			writeInline("<code>" + escape(string(p)) + "</code>")
+		case docKey:
+			writeInline("<kbd>" + escape(string(p)) + "</kbd>")
+		case docAdmonition:
+			endParagraph()
+			content, err := genHTMLParts(p.content, w, notes)
+			if err != nil {
+				return "", err
 			}
-			write(escapeHTML(p.text))
-			if p.italic {
-				write("</i>")
+			write(`<aside class="admonition ` + string(p.kind) + `">`)
+			write(`<p class="admonition-title">` + htmlAdmonitionIcon(p.kind) + escape(p.kind.title()) + `</p>`)
+			write(content + "</aside>")
+		case docFootnote:
+			*notes = append(*notes, p)
+			writeInline(fmt.Sprintf(
+				`<sup class="footnote-ref"><a id="%s" href="#%s">%d</a></sup>`,
+				htmlFootnoteRefID(p.number), htmlFootnoteID(p.number), p.number,
+			))
+		default:
+			return "", fmt.Errorf("error generating HTML: unhandled document part: %T", p)
+		}
+	}
+	endParagraph()
+	return buf.String(), nil
+}
+
+// genHTMLTOC creates a nested list of links to all captions in the document,
+// except for the document title. list is the list element, ul or ol. The
+// first caption is at the top level, even if it is a sub-caption, and levels
+// that are skipped are not nested, so every list item has a link.
+func genHTMLTOC(parts []docPart, list string, href func(id string) string) string {
+	var buf bytes.Buffer
+	depth := 0
+	firstLevel := 0
+	for _, part := range parts {
+		h, level, ok := headingOf(part)
+		if !ok || level == 1 {
+			// only list captions, not the title
+			continue
+		}
+		if firstLevel == 0 {
+			firstLevel = level
+		}
+		level -= firstLevel - 1
+		if level < 1 {
+			level = 1
+		}
+		if level > depth+1 {
+			level = depth + 1
+		}
+		if level > depth {
+			for depth < level {
+				buf.WriteString("<" + list + "><li>")
+				depth++
 			}
-			if p.bold {
-				write("</b>")
+		} else {
+			for depth > level {
+				buf.WriteString("</li></" + list + ">")
+				depth--
 			}
-		default:
-			return nil, fmt.Errorf("error generating HTML: unhandled document part: %T", p)
+			buf.WriteString("</li><li>")
 		}
+		buf.WriteString(fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(href(h.id)), escapeHTML(h.text)))
 	}
-	write(`</body></html>`)
+	for depth > 0 {
+		buf.WriteString("</li></" + list + ">")
+		depth--
+	}
+	return buf.String()
+}
 
-	return buf.Bytes(), nil
+// htmlStyleTags are the elements of the text styles, from the innermost to the
+// outermost.
+var htmlStyleTags = []struct {
+	style textStyle
+	tag   string
+}{
+	{styleHighlight, "mark"},
+	{styleSub, "sub"},
+	{styleSuper, "sup"},
+	{styleStrike, "s"},
+	{styleUnderline, "u"},
+	{styleItalic, "i"},
+	{styleBold, "b"},
+}
+
+// htmlStyled puts the escaped text in the elements of its style.
+func htmlStyled(s string, style textStyle) string {
+	for _, t := range htmlStyleTags {
+		if style.has(t.style) {
+			s = "<" + t.tag + ">" + s + "</" + t.tag + ">"
+		}
+	}
+	return s
+}
+
+// htmlAdmonitionIcons are the shapes of the admonition icons, they are drawn
+// with lines in the text color on a 24x24 grid. The elements are closed
+// explicitly, HTML does not allow self-closing elements.
+var htmlAdmonitionIcons = map[admonitionKind]string{
+	// a circled i
+	admonitionNote: `<circle cx="12" cy="12" r="10"></circle><path d="M12 11v6M12 7v.01"></path>`,
+	// a light bulb
+	admonitionTip: `<path d="M9 18h6M10 22h4M12 2a7 7 0 0 0-4 12.7V16h8v-1.3A7 7 0 0 0 12 2z"></path>`,
+	// an exclamation mark in a triangle
+	admonitionWarning: `<path d="M12 2L1 21h22z"></path><path d="M12 9v6M12 18v.01"></path>`,
+	// a cross in an octagon
+	admonitionDanger: `<path d="M7.9 2h8.2L22 7.9v8.2L16.1 22H7.9L2 16.1V7.9z"></path><path d="M9 9l6 6M15 9l-6 6"></path>`,
+}
+
+// htmlAdmonitionIcon returns an inline SVG image of the admonition's icon, its
+// size is that of the surrounding text.
+func htmlAdmonitionIcon(kind admonitionKind) string {
+	return `<svg class="admonition-icon" xmlns="http://www.w3.org/2000/svg" width="1em" height="1em" viewBox="0 0 24 24"` +
+		` fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round" aria-hidden="true">` +
+		htmlAdmonitionIcons[kind] + `</svg>`
 }
 
 func escapeHTML(s string) string {
@@ -94,11 +349,10 @@ func escapeHTML(s string) string {
 	s = html.EscapeString(s)
 	s = strings.Replace(s, "  ", "&nbsp;&nbsp;", -1)
 	s = strings.Replace(s, "&nbsp; ", "&nbsp;&nbsp;", -1)
-	s = strings.Replace(s, "®", "<sup>®</sup>", -1)
 	return s
 }
 
-func imageTag(img image.Image) (string, error) {
+func imageDataURI(img image.Image) (string, error) {
 	var buf bytes.Buffer
 	e := base64.NewEncoder(base64.StdEncoding, &buf)
 	err := png.Encode(e, img)
@@ -109,5 +363,5 @@ func imageTag(img image.Image) (string, error) {
 	if err != nil {
 		return "", errors.New("cannot encode image as Base64: " + err.Error())
 	}
-	return `<img src="data:image/png;base64,` + string(buf.Bytes()) + `">`, nil
+	return "data:image/png;base64," + string(buf.Bytes()), nil
 }
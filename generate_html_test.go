@@ -1,22 +1,262 @@
 package main
 
 import (
+	"html/template"
+	"io"
 	"strings"
 	"testing"
+
+	"golang.org/x/net/html"
 )
 
 func TestMultipleSpacesAreKept(t *testing.T) {
-	checkHTMLbody(t, "two&nbsp;&nbsp;spaces", "", docText("two  spaces"))
-	checkHTMLbody(t, "three&nbsp;&nbsp;&nbsp;spaces", "", docText("three   spaces"))
-	checkHTMLbody(t, "4&nbsp;&nbsp;&nbsp;&nbsp;spaces", "", docText("4    spaces"))
+	checkHTMLbody(t, "<p>two&nbsp;&nbsp;spaces</p>", "", docText("two  spaces"))
+	checkHTMLbody(t, "<p>three&nbsp;&nbsp;&nbsp;spaces</p>", "", docText("three   spaces"))
+	checkHTMLbody(t, "<p>4&nbsp;&nbsp;&nbsp;&nbsp;spaces</p>", "", docText("4    spaces"))
 }
 
 func TestTabsAreReplacedByFourSpaces(t *testing.T) {
-	checkHTMLbody(t, "a&nbsp;&nbsp;&nbsp;&nbsp;tab", "", docText("a\ttab"))
+	checkHTMLbody(t, "<p>a&nbsp;&nbsp;&nbsp;&nbsp;tab</p>", "", docText("a\ttab"))
+}
+
+func TestTrademarkRIsNormalText(t *testing.T) {
+	checkHTMLbody(t, "<p>®</p>", "", docText("®"))
+}
+
+func TestSuperscriptIsSupElement(t *testing.T) {
+	checkHTMLbody(t, "<p><sup>®</sup></p>", "", styled("®", styleSuper))
+}
+
+func TestStylesAreNested(t *testing.T) {
+	checkHTMLbody(t, "<p><b><i><u><s><mark>x</mark></s></u></i></b></p>", "",
+		styled("x", styleBold|styleItalic|styleUnderline|styleStrike|styleHighlight))
+	checkHTMLbody(t, "<p>H<sub>2</sub>O</p>", "",
+		docText("H"), styled("2", styleSub), docText("O"))
+}
+
+func TestCodeAndKeysUseCodeAndKbdElements(t *testing.T) {
+	checkHTMLbody(t, "<p><code>a&lt;b</code> <kbd>Ctrl+S</kbd></p>", "",
+		docCode("a<b"), docText(" "), docKey("Ctrl+S"))
+}
+
+func TestLinksCanBeStyled(t *testing.T) {
+	checkHTMLbody(t, `<p><a href="#a"><b>A</b></a> <a href="http://b.c"><i>B</i></a></p>`, "",
+		docLink{id: "a", text: "A", style: styleBold},
+		docText(" "),
+		externalDocLink{url: "http://b.c", text: "B", style: styleItalic},
+	)
+}
+
+func TestAdmonitionsAreAsides(t *testing.T) {
+	checkHTMLbody(t,
+		`<p>a</p><aside class="admonition tip"><p class="admonition-title">`+htmlAdmonitionIcon(admonitionTip)+
+			`Tip</p><p>b</p><p>c</p></aside><p>d</p>`, "",
+		docText("a"),
+		docAdmonition{kind: admonitionTip, content: document{parts: []docPart{
+			docText("b"), docParagraphBreak{}, docText("c"),
+		}}},
+		docText("d"),
+	)
+}
+
+func TestFootnotesAreListedAtTheEnd(t *testing.T) {
+	checkHTMLbody(t,
+		`<p>a<sup class="footnote-ref"><a id="fnref:1" href="#fn:1">1</a></sup> b</p>`+
+			`<section class="footnotes"><hr><ol>`+
+			`<li id="fn:1" value="1"><p>note <b>c</b> <a class="footnote-back" href="#fnref:1">↩</a></p></li>`+
+			`</ol></section>`, "",
+		docText("a"),
+		docFootnote{number: 1, content: document{parts: []docPart{
+			docText("note "), bold("c"),
+		}}},
+		docText(" b"),
+	)
+}
+
+func TestCustomCSSIsInlinedAfterTheme(t *testing.T) {
+	output, err := genHTMLWithOptions(
+		document{parts: []docPart{docText("text")}},
+		htmlOptions{theme: "dark", css: "body{color:red}"},
+	)
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	html := string(output)
+	theme := strings.Index(html, darkTheme)
+	custom := strings.Index(html, "body{color:red}")
+	if theme == -1 || custom == -1 || custom < theme {
+		t.Errorf("custom CSS must follow the theme, have\n%s", html)
+	}
+}
+
+func TestUnknownThemeIsError(t *testing.T) {
+	_, err := genHTMLWithOptions(document{}, htmlOptions{theme: "neon"})
+	if err == nil {
+		t.Fatal("error expected for unknown theme")
+	}
+}
+
+func TestTemplateGetsTitleTOCAndBody(t *testing.T) {
+	tmpl := template.Must(template.New("").Parse(
+		`<title>{{.Title}}</title><nav>{{.TOC}}</nav>{{.Body}}`,
+	))
+	doc := document{
+		title: "A & B",
+		parts: []docPart{
+			docTitle{text: "A & B", id: "a-b"},
+			docCaption{text: "One", id: "one"},
+			docSubCaption{text: "One.One", id: "one-one"},
+			docCaption{text: "Two", id: "two"},
+		},
+	}
+	output, err := genHTMLWithOptions(doc, htmlOptions{theme: "none", template: tmpl})
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	want := `<title>A &amp; B</title>` +
+		`<nav><ul><li><a href="#one">One</a>` +
+		`<ul><li><a href="#one-one">One.One</a></li></ul></li>` +
+		`<li><a href="#two">Two</a></li></ul></nav>` +
+		`<h1 id="a-b">A &amp; B</h1>` +
+		`<h2 id="one">One</h2>` +
+		`<h3 id="one-one">One.One</h3>` +
+		`<h2 id="two">Two</h2>`
+	if string(output) != want {
+		t.Errorf("want\n%s\nbut have\n%s", want, output)
+	}
+}
+
+func TestParagraphBreaksSeparateParagraphs(t *testing.T) {
+	checkHTMLbody(
+		t,
+		"<p>one</p><p>two</p>",
+		"",
+		docText("one"),
+		docParagraphBreak{},
+		docText("two"),
+	)
+}
+
+func TestLineBreaksAreBrElements(t *testing.T) {
+	checkHTMLbody(
+		t,
+		"<p>text<br><b>bold</b></p>",
+		"",
+		docText("text"),
+		docLineBreak{},
+		bold("bold"),
+		docLineBreak{},
+	)
+}
+
+func TestCaptionsEndParagraphs(t *testing.T) {
+	checkHTMLbody(
+		t,
+		`<p>text</p><h2 id="cap">Cap</h2><p>more</p>`,
+		"",
+		docText("text"),
+		docCaption{text: "Cap", id: "cap"},
+		docText("more"),
+	)
 }
 
-func TestTrademarkRIsSuperscripted(t *testing.T) {
-	checkHTMLbody(t, "<sup>®</sup>", "", docText("®"))
+func TestTitleIsEscaped(t *testing.T) {
+	output, err := genHTML(document{title: "</title><script>"})
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	if !strings.Contains(string(output), "<title>&lt;/title&gt;&lt;script&gt;</title>") {
+		t.Errorf("title is not escaped:\n%s", output)
+	}
+}
+
+func TestHTMLIsWellFormed(t *testing.T) {
+	doc, err := parse([]byte(`================
+Title & <Things>
+================
+Some text, *bold*, /italic/ and */both/*.
+Second line with a [link[Chapter]].
+
+New paragraph [www.example.com].
+Chapter
+=======
+Sub "Chapter"
+-------------
+Text with a [mail link[info@example.com]].
+!!! danger
+Do *not* do this.
+!!!
+`))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	output, err := genHTMLWithOptions(doc, htmlOptions{theme: "auto", lang: "de-AT"})
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	checkWellFormedHTML(t, string(output))
+	if !strings.Contains(string(output), `<html lang="de-AT">`) {
+		t.Errorf("missing lang attribute:\n%s", output)
+	}
+}
+
+// checkWellFormedHTML tokenizes the given HTML5 document and makes sure it
+// starts with a doctype, that the charset is declared inside the head, that
+// all elements are closed in the right order and that only void elements are
+// self-closing.
+func checkWellFormedHTML(t *testing.T, doc string) {
+	t.Helper()
+	voidElements := map[string]bool{
+		"br": true, "img": true, "meta": true, "hr": true, "link": true,
+	}
+	var open []string
+	tokens := html.NewTokenizer(strings.NewReader(doc))
+	first := true
+	for {
+		tt := tokens.Next()
+		if tt == html.ErrorToken {
+			if tokens.Err() != io.EOF {
+				t.Fatal("tokenizer error:", tokens.Err())
+			}
+			break
+		}
+		tok := tokens.Token()
+		if first {
+			if tt != html.DoctypeToken || tok.Data != "html" {
+				t.Fatalf("document must start with <!DOCTYPE html> but starts with %v", tok)
+			}
+			first = false
+			continue
+		}
+		switch tt {
+		case html.DoctypeToken:
+			t.Errorf("second doctype: %v", tok)
+		case html.SelfClosingTagToken:
+			if !voidElements[tok.Data] {
+				t.Errorf("non-void element <%s/> is self-closing", tok.Data)
+			}
+		case html.StartTagToken:
+			if tok.Data == "meta" {
+				if len(open) != 2 || open[1] != "head" {
+					t.Errorf("<meta> must be in <head> but is in %v", open)
+				}
+			}
+			if !voidElements[tok.Data] {
+				open = append(open, tok.Data)
+			}
+		case html.EndTagToken:
+			if voidElements[tok.Data] {
+				t.Errorf("void element %s has an end tag", tok.Data)
+			} else if len(open) == 0 || open[len(open)-1] != tok.Data {
+				t.Fatalf("</%s> does not close the open elements %v", tok.Data, open)
+			} else {
+				open = open[:len(open)-1]
+			}
+		}
+	}
+	if len(open) != 0 {
+		t.Errorf("unclosed elements: %v", open)
+	}
 }
 
 func checkHTMLbody(t *testing.T, want string, docTitle string, docParts ...docPart) {
@@ -33,3 +273,17 @@ func checkHTMLbody(t *testing.T, want string, docTitle string, docParts ...docPa
 		t.Errorf("HTML body differs, want\n'%s'\nbut have\n'%s'", want, body)
 	}
 }
+
+func TestMissingImageErrorHasSourcePosition(t *testing.T) {
+	doc, err := parseFile("help.txt", []byte("text\n\n[does-not-exist.png]"))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	_, err = genHTML(doc)
+	if err == nil {
+		t.Fatal("error expected for missing image")
+	}
+	if !strings.HasPrefix(err.Error(), "help.txt:3:1: error generating HTML image 'does-not-exist.png'") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
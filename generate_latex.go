@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// latexOptions control where the LaTeX generator puts its images.
+type latexOptions struct {
+	// imageDir is the folder that the .tex file is written to, images are
+	// saved as PNG files in its sub-folder latexImageFolder
+	imageDir string
+}
+
+// latexImageFolder only contains images written by helpgen so existing files
+// are never overwritten.
+const latexImageFolder = "helpgen-images"
+
+func genLaTeX(doc document) ([]byte, error) {
+	return genLaTeXWithOptions(doc, latexOptions{imageDir: "."})
+}
+
+// genLaTeXWithOptions creates a LaTeX article. The title goes into \title,
+// captions become sections with labels made from their ids. Images are written as
+// separate files because LaTeX cannot embed them in the .tex file.
+func genLaTeXWithOptions(doc document, opts latexOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	write := func(s string) {
+		buf.WriteString(s)
+	}
+	// ids can contain characters that are special in LaTeX, the bookmark
+	// names are safe labels
+	labels := bookmarkNames(doc)
+	writeCaption := func(command string, cap heading) {
+		// sections start a new paragraph, there only needs to be one empty line
+		for bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.Truncate(buf.Len() - 1)
+		}
+		write("\n\n" + command + "{" + escapeLaTeX(cap.text) + "}\\label{" + labels[cap.id] + "}\n")
+	}
+
+	imageFiles := make(map[string]string)
+
+	write(`\documentclass{article}
+\usepackage[utf8]{inputenc}
+\usepackage[T1]{fontenc}
+\usepackage{graphicx}
+\usepackage{hyperref}
+\usepackage[normalem]{ulem}
+\usepackage{xcolor}
+`)
+	if doc.title != "" {
+		write(`\title{` + escapeLaTeX(doc.title) + "}\n")
+	}
+	write("\\date{}\n\\begin{document}\n")
+
+	// writeParts writes the parts of the document, it is called again for
+	// the content of admonitions and footnotes
+	var writeParts func(doc document) error
+	writeParts = func(doc document) error {
+		for i, part := range doc.parts {
+			switch p := part.(type) {
+			case docText:
+				write(escapeLaTeX(string(p)))
+			case docParagraphBreak:
+				write("\n\n")
+			case docLineBreak:
+				write("\\\\\n")
+			case docImage:
+				key := strings.ToLower(p.name)
+				file, ok := imageFiles[key]
+				img, err := findImage(p.name)
+				if err != nil {
+					return doc.errorAt(i, fmt.Errorf("error generating LaTeX image '%s': %s", p.name, err.Error()))
+				}
+				if !ok {
+					var data bytes.Buffer
+					if err := png.Encode(&data, img); err != nil {
+						return fmt.Errorf("error encoding LaTeX png '%s': %s", p.name, err.Error())
+					}
+					file = fmt.Sprintf("%s/image%d.png", latexImageFolder, len(imageFiles)+1)
+					if err := os.MkdirAll(filepath.Join(opts.imageDir, latexImageFolder), 0777); err != nil {
+						return fmt.Errorf("error creating LaTeX image folder: %s", err.Error())
+					}
+					path := filepath.Join(opts.imageDir, filepath.FromSlash(file))
+					if err := ioutil.WriteFile(path, data.Bytes(), 0666); err != nil {
+						return fmt.Errorf("error writing LaTeX image '%s': %s", path, err.Error())
+					}
+					imageFiles[key] = file
+				}
+				// images are shown at 96 pixels per inch but not wider than the
+				// text
+				width := fmt.Sprintf("%.2fin", float64(img.Bounds().Dx())/96)
+				if img.Bounds().Dx() > 96*6 {
+					width = `\linewidth`
+				}
+				write(`\includegraphics[width=` + width + `]{` + file + `}`)
+			case docTitle:
+				write("\\maketitle\n\\phantomsection\\label{" + labels[p.id] + "}\n")
+			case docCaption:
+				writeCaption(`\section`, heading(p))
+			case docSubCaption:
+				writeCaption(`\subsection`, heading(p))
+			case docSubSubCaption:
+				writeCaption(`\subsubsection`, heading(p))
+			case docLink:
+				write(`\hyperref[` + labels[p.id] + `]{` + latexStyled(escapeLaTeX(p.text), p.style) + `}`)
+			case externalDocLink:
+				write(`\href{` + escapeLaTeXURL(p.url) + `}{` + latexStyled(escapeLaTeX(p.text), p.style) + `}`)
+			case stylizedDocText:
+				write(latexStyled(escapeLaTeX(p.text), p.style))
+			case docCode:
+				write(`\texttt{` + escapeLaTeX(string(p)) + `}`)
+			case docKey:
+				write(`\fbox{\texttt{` + escapeLaTeX(string(p)) + `}}`)
+			case docFootnote:
+				write(`\footnote{`)
+				if err := writeParts(p.content); err != nil {
+					return err
+				}
+				write(`}`)
+			case docAdmonition:
+				write("\n\n\\begin{quote}\n\\textbf{" + escapeLaTeX(p.kind.title()) + "}\n\n")
+				if err := writeParts(p.content); err != nil {
+					return err
+				}
+				write("\n\\end{quote}\n\n")
+			default:
+				return fmt.Errorf("error generating LaTeX: unhandled document part: %T", p)
+			}
+		}
+		return nil
+	}
+	if err := writeParts(doc); err != nil {
+		return nil, err
+	}
+
+	write("\n\\end{document}\n")
+	return buf.Bytes(), nil
+}
+
+// latexStyleCommands are the commands of the text styles, from the innermost
+// to the outermost.
+var latexStyleCommands = []struct {
+	style   textStyle
+	command string
+}{
+	{styleHighlight, `\colorbox{yellow}`},
+	{styleSub, `\textsubscript`},
+	{styleSuper, `\textsuperscript`},
+	{styleStrike, `\sout`},
+	{styleUnderline, `\uline`},
+	{styleItalic, `\textit`},
+	{styleBold, `\textbf`},
+}
+
+// latexStyled puts the escaped text in the commands of its style.
+func latexStyled(s string, style textStyle) string {
+	for _, c := range latexStyleCommands {
+		if style.has(c.style) {
+			s = c.command + `{` + s + `}`
+		}
+	}
+	return s
+}
+
+var latexEscaper = strings.NewReplacer(
+	`\`, `\textbackslash{}`,
+	`{`, `\{`,
+	`}`, `\}`,
+	`$`, `\$`,
+	`&`, `\&`,
+	`#`, `\#`,
+	`%`, `\%`,
+	`_`, `\_`,
+	`^`, `\textasciicircum{}`,
+	`~`, `\textasciitilde{}`,
+	`<`, `\textless{}`,
+	`>`, `\textgreater{}`,
+	`|`, `\textbar{}`,
+	// -- and --- would become dashes, which breaks command line options
+	`-`, `-{}`,
+)
+
+// escapeLaTeX escapes all characters that have a special meaning in LaTeX.
+func escapeLaTeX(s string) string {
+	return latexEscaper.Replace(s)
+}
+
+var latexURLEscaper = strings.NewReplacer(
+	`\`, `%5C`,
+	`{`, `%7B`,
+	`}`, `%7D`,
+	`#`, `\#`,
+	`%`, `\%`,
+)
+
+// escapeLaTeXURL escapes the URL argument of \href.
+func escapeLaTeXURL(s string) string {
+	return latexURLEscaper.Replace(s)
+}
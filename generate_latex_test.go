@@ -0,0 +1,100 @@
+package main
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLaTeX(t *testing.T) {
+	doc, err := parse([]byte(`=====
+Title
+=====
+See [Two], [www.example.com/a#b] and *-v*.
+Two
+===
+100% of $5 & /more/_stuff {x}\
+back[\]slash
+Sub
+---
+Sub sub
+.......
+*/both/*
+` + "`a_b`" + ` [key:Esc]`))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	output, err := genLaTeX(doc)
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	want := `\documentclass{article}
+\usepackage[utf8]{inputenc}
+\usepackage[T1]{fontenc}
+\usepackage{graphicx}
+\usepackage{hyperref}
+\usepackage[normalem]{ulem}
+\usepackage{xcolor}
+\title{Title}
+\date{}
+\begin{document}
+\maketitle
+\phantomsection\label{_title}
+See \hyperref[_two]{Two}, \href{http://www.example.com/a\#b}{www.example.com/a\#b} and \textbf{-{}v}.
+
+\section{Two}\label{_two}
+100\% of \$5 \& \textit{more}\_stuff \{x\}\\
+back\textbackslash{}slash
+
+\subsection{Sub}\label{_sub}
+
+\subsubsection{Sub sub}\label{_sub_sub}
+\textbf{\textit{both}} \texttt{a\_b} \fbox{\texttt{Esc}}
+\end{document}
+`
+	if string(output) != want {
+		t.Errorf("want\n%s\nbut have\n%s", want, output)
+	}
+}
+
+func TestLaTeXLabelsAreSafe(t *testing.T) {
+	output, err := genLaTeX(document{parts: []docPart{
+		docCaption{id: "größe#1", text: "Größe"},
+		docLink{id: "größe#1", text: "size"},
+	}})
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	for _, want := range []string{`\section{Größe}\label{_gr__e_1}`, `\hyperref[_gr__e_1]{size}`} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("want %s in\n%s", want, output)
+		}
+	}
+}
+
+func TestLaTeXImagesGoIntoTheirOwnFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helpgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	imageCache["a.png"] = image.NewRGBA(image.Rect(0, 0, 2, 2))
+	defer delete(imageCache, "a.png")
+
+	output, err := genLaTeXWithOptions(
+		document{parts: []docPart{docImage{name: "a.png"}}},
+		latexOptions{imageDir: dir},
+	)
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	if !strings.Contains(string(output), `{helpgen-images/image1.png}`) {
+		t.Errorf("image is not included:\n%s", output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "helpgen-images", "image1.png")); err != nil {
+		t.Error("image was not written:", err)
+	}
+}
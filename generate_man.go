@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// manOptions are the fields of the man page's title line.
+type manOptions struct {
+	// section is the manual section, e.g. 1 for commands
+	section string
+	// date is the date of the last change, today if empty
+	date string
+}
+
+func genMan(doc document) ([]byte, error) {
+	return genManWithOptions(doc, manOptions{section: "1"})
+}
+
+// genManWithOptions creates a Unix man page in roff format. The title goes into
+// the .TH line, captions become sections and sub-captions become sub-sections.
+func genManWithOptions(doc document, opts manOptions) ([]byte, error) {
+	var w roffWriter
+	name := strings.ToUpper(doc.title)
+	if name == "" {
+		name = "HELP"
+	}
+	date := opts.date
+	if date == "" {
+		date = time.Now().Format("2006-01-02")
+	}
+	section := opts.section
+	if section == "" {
+		section = "1"
+	}
+	w.macro(".TH", escapeRoffArg(name), escapeRoffArg(section), escapeRoffArg(date))
+
+	// notes are written in a section of their own at the end of the page
+	var notes []docFootnote
+
+	// writeParts writes the parts of the document, it is called again for
+	// the content of admonitions and footnotes
+	var writeParts func(doc document) error
+	writeParts = func(doc document) error {
+		for _, part := range doc.parts {
+			switch p := part.(type) {
+			case docText:
+				w.text(string(p))
+			case docParagraphBreak:
+				w.macro(".PP")
+			case docLineBreak:
+				w.macro(".br")
+			case docImage:
+				w.comment("image " + p.name + " cannot be shown in a man page")
+			case docTitle:
+				// the title is already in the .TH line
+			case docCaption:
+				w.macro(".SH", escapeRoffText(p.text))
+			case docSubCaption:
+				w.macro(".SS", escapeRoffText(p.text))
+			case docSubSubCaption:
+				w.macro(".PP")
+				w.macro(".B", escapeRoffText(p.text))
+				w.macro(".PP")
+			case docLink:
+				w.text(p.text)
+			case externalDocLink:
+				w.macro(".UR", escapeRoffArg(p.url))
+				w.text(p.text)
+				w.suffixMacro(".UE")
+			case stylizedDocText:
+				// man pages only have bold and italic, terminals show italic
+				// text underlined
+				bold := p.style.has(styleBold)
+				italic := p.style&(styleItalic|styleUnderline) != 0
+				if bold || italic {
+					w.styled(p.text, bold, italic)
+				} else {
+					w.text(p.text)
+				}
+			case docCode:
+				w.addText(`\f(CR`+escapeRoff(string(p))+`\fR`, false)
+			case docKey:
+				w.addText(`\fB`+escapeRoff(string(p))+`\fR`, false)
+			case docFootnote:
+				w.addText(fmt.Sprintf("[%d]", p.number), false)
+				notes = append(notes, p)
+			case docAdmonition:
+				// admonitions are indented with their kind in bold above them
+				w.macro(".PP")
+				w.macro(".RS")
+				w.macro(".B", escapeRoffText(p.kind.title()))
+				w.macro(".PP")
+				if err := writeParts(p.content); err != nil {
+					return err
+				}
+				w.macro(".RE")
+				w.macro(".PP")
+			default:
+				return fmt.Errorf("error generating man page: unhandled document part: %T", p)
+			}
+		}
+		return nil
+	}
+	if err := writeParts(doc); err != nil {
+		return nil, err
+	}
+	if len(notes) > 0 {
+		w.macro(".SH", "NOTES")
+		for _, note := range notes {
+			w.macro(".IP", fmt.Sprintf("[%d]", note.number), "4")
+			if err := writeParts(note.content); err != nil {
+				return nil, err
+			}
+		}
+	}
+	w.flush()
+	return w.buf.Bytes(), nil
+}
+
+// roffWriter collects text into lines and writes macros on lines of their own.
+type roffWriter struct {
+	buf  bytes.Buffer
+	line string
+	// pending is a macro that is not yet written because punctuation directly
+	// following it has to be passed as its last argument, otherwise roff would
+	// insert a space
+	pending []string
+}
+
+func (w *roffWriter) flush() {
+	if w.pending != nil {
+		w.writeMacro(w.pending)
+		w.pending = nil
+	}
+	line := strings.TrimRight(w.line, " ")
+	if line != "" {
+		// lines starting with . or ' would be taken for macros
+		if line[0] == '.' || line[0] == '\'' {
+			line = `\&` + line
+		}
+		w.buf.WriteString(line + "\n")
+	}
+	w.line = ""
+}
+
+// text adds text to the current line, escaping all special characters.
+func (w *roffWriter) text(s string) {
+	w.addText(s, true)
+}
+
+func (w *roffWriter) addText(s string, escape bool) {
+	if w.pending != nil {
+		suffix := s
+		if i := strings.IndexAny(s, " \t"); i != -1 {
+			suffix = s[:i]
+		}
+		s = s[len(suffix):]
+		if escape {
+			suffix = escapeRoffText(suffix)
+		}
+		if suffix != "" {
+			w.pending = append(w.pending, suffix)
+		}
+		w.flush()
+	}
+	if w.line == "" {
+		// a line starting with spaces would force a line break
+		s = strings.TrimLeft(s, " \t")
+	}
+	if escape {
+		s = escapeRoff(s)
+	}
+	w.line += s
+}
+
+// macro writes a macro line, the arguments must already be escaped.
+func (w *roffWriter) macro(name string, args ...string) {
+	w.flush()
+	w.writeMacro(append([]string{name}, args...))
+}
+
+// suffixMacro writes a macro that takes punctuation which follows it as its
+// last argument.
+func (w *roffWriter) suffixMacro(name string, args ...string) {
+	w.flush()
+	w.pending = append([]string{name}, args...)
+}
+
+func (w *roffWriter) writeMacro(macro []string) {
+	w.buf.WriteString(macro[0])
+	for _, arg := range macro[1:] {
+		w.buf.WriteString(` "` + arg + `"`)
+	}
+	w.buf.WriteString("\n")
+}
+
+func (w *roffWriter) comment(s string) {
+	w.flush()
+	w.buf.WriteString(`.\" ` + s + "\n")
+}
+
+// styled writes bold and italic text. Whole words are written with the .B and
+// .I macros, styled text inside a word uses font escapes.
+func (w *roffWriter) styled(text string, bold, italic bool) {
+	wordStart := w.pending == nil && (w.line == "" || strings.HasSuffix(w.line, " "))
+	if wordStart && bold != italic {
+		if bold {
+			w.suffixMacro(".BR", escapeRoffText(text))
+		} else {
+			w.suffixMacro(".IR", escapeRoffText(text))
+		}
+		return
+	}
+	font := `\fB`
+	if bold && italic {
+		font = `\f(BI`
+	} else if italic {
+		font = `\fI`
+	}
+	w.addText(font+escapeRoff(text)+`\fR`, false)
+}
+
+var roffEscaper = strings.NewReplacer(
+	`\`, `\e`,
+	`-`, `\-`,
+)
+
+// escapeRoff escapes backslashes and minus signs, the latter would otherwise
+// be printed as hyphens which cannot be copied as command line options.
+func escapeRoff(s string) string {
+	return roffEscaper.Replace(s)
+}
+
+var roffArgEscaper = strings.NewReplacer(
+	`\`, `\e`,
+	`"`, `\(dq`,
+)
+
+// escapeRoffArg escapes a quoted macro argument. Minus signs are kept as they
+// are because these arguments are URLs or dates.
+func escapeRoffArg(s string) string {
+	return roffArgEscaper.Replace(s)
+}
+
+// escapeRoffText escapes text that is passed as a quoted macro argument.
+func escapeRoffText(s string) string {
+	return strings.Replace(escapeRoff(s), `"`, `\(dq`, -1)
+}
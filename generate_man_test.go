@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestManPage(t *testing.T) {
+	doc, err := parse([]byte(`=====
+tool
+=====
+Options
+=======
+Use *-v* or */both/* and /this/, see [www.example.com].
+.dot\
+back[\]slash
+Sub "quoted"
+------------
+Last *word*`))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	output, err := genManWithOptions(doc, manOptions{section: "8", date: "2020-01-02"})
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	want := `.TH "TOOL" "8" "2020-01-02"
+.SH "Options"
+Use
+.BR "\-v"
+or \f(BIboth\fR and
+.IR "this" ","
+see
+.UR "http://www.example.com"
+www.example.com
+.UE "."
+\&.dot
+.br
+back\eslash
+.SS "Sub \(dqquoted\(dq"
+Last
+.BR "word"
+`
+	if string(output) != want {
+		t.Errorf("want\n%s\nbut have\n%s", want, output)
+	}
+}
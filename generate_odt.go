@@ -0,0 +1,357 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image/png"
+	"strings"
+)
+
+// odtMaxImageWidth is the width between the page margins in centimeters.
+const odtMaxImageWidth = 17.0
+
+// genODT creates an OpenDocument text document. Captions are headings with
+// outline levels 1 to 4 and have bookmarks as link targets.
+func genODT(doc document) ([]byte, error) {
+	var body bytes.Buffer
+	write := func(s string) {
+		body.WriteString(s)
+	}
+
+	type picture struct {
+		file string
+		data []byte
+	}
+	var pictures []picture
+	pictureFiles := make(map[string]string)
+	// frames are numbered for their unique names, images can be used more
+	// than once
+	frameCount := 0
+
+	// paragraphStyle is the style of the next paragraph
+	inParagraph := false
+	paragraphStyle := "Text_20_body"
+	startParagraph := func() {
+		if !inParagraph {
+			write(`<text:p text:style-name="` + paragraphStyle + `">`)
+		}
+		inParagraph = true
+	}
+	endParagraph := func() {
+		if inParagraph {
+			write("</text:p>")
+		}
+		inParagraph = false
+	}
+	bookmarks := bookmarkNames(doc)
+	writeCaption := func(cap heading, level int) {
+		endParagraph()
+		name := bookmarks[cap.id]
+		write(fmt.Sprintf(
+			`<text:h text:style-name="Heading_20_%d" text:outline-level="%d">`+
+				`<text:bookmark-start text:name="%s"/>%s<text:bookmark-end text:name="%s"/></text:h>`,
+			level, level, name, odtText(cap.text), name,
+		))
+	}
+
+	// writeParts writes the parts of the document, it is called again for
+	// the content of admonitions and footnotes
+	var writeParts func(doc document) error
+	writeParts = func(doc document) error {
+		for i, part := range doc.parts {
+			switch part.(type) {
+			case docText, docImage, docLink, externalDocLink, stylizedDocText, docCode, docKey, docLineBreak, docFootnote:
+				startParagraph()
+			}
+
+			switch p := part.(type) {
+			case docText:
+				write(odtText(string(p)))
+			case docParagraphBreak:
+				endParagraph()
+			case docLineBreak:
+				write("<text:line-break/>")
+			case docImage:
+				img, err := findImage(p.name)
+				if err != nil {
+					return doc.errorAt(i, fmt.Errorf("error generating ODT image '%s': %s", p.name, err.Error()))
+				}
+				key := strings.ToLower(p.name)
+				file, ok := pictureFiles[key]
+				if !ok {
+					var buf bytes.Buffer
+					if err := png.Encode(&buf, img); err != nil {
+						return fmt.Errorf("error encoding ODT png '%s': %s", p.name, err.Error())
+					}
+					file = fmt.Sprintf("Pictures/image%d.png", len(pictures)+1)
+					pictures = append(pictures, picture{file: file, data: buf.Bytes()})
+					pictureFiles[key] = file
+				}
+				// images are shown at 96 pixels per inch
+				w := float64(img.Bounds().Dx()) * 2.54 / 96
+				h := float64(img.Bounds().Dy()) * 2.54 / 96
+				if w > odtMaxImageWidth {
+					h *= odtMaxImageWidth / w
+					w = odtMaxImageWidth
+				}
+				frameCount++
+				write(fmt.Sprintf(
+					`<draw:frame draw:name="Image%d" text:anchor-type="as-char" svg:width="%.3fcm" svg:height="%.3fcm">`+
+						`<draw:image xlink:href="%s" xlink:type="simple" xlink:show="embed" xlink:actuate="onLoad"/>`+
+						`</draw:frame>`,
+					frameCount, w, h, file,
+				))
+			case docTitle:
+				writeCaption(heading(p), 1)
+			case docCaption:
+				writeCaption(heading(p), 2)
+			case docSubCaption:
+				writeCaption(heading(p), 3)
+			case docSubSubCaption:
+				writeCaption(heading(p), 4)
+			case docLink:
+				write(`<text:a xlink:type="simple" xlink:href="#` + bookmarks[p.id] + `">`)
+				write(odtStyled(odtText(p.text), p.style))
+				write(`</text:a>`)
+			case externalDocLink:
+				write(`<text:a xlink:type="simple" xlink:href="` + xmlEscape(p.url) + `">`)
+				write(odtStyled(odtText(p.text), p.style))
+				write(`</text:a>`)
+			case stylizedDocText:
+				write(odtStyled(odtText(p.text), p.style))
+			case docCode:
+				write(`<text:span text:style-name="Code">` + odtText(string(p)) + `</text:span>`)
+			case docKey:
+				write(`<text:span text:style-name="Key">` + odtText(string(p)) + `</text:span>`)
+			case docFootnote:
+				write(fmt.Sprintf(
+					`<text:note text:id="ftn%d" text:note-class="footnote"><text:note-citation>%d</text:note-citation>`+
+						`<text:note-body><text:p text:style-name="Footnote">`,
+					p.number, p.number,
+				))
+				if err := writeParts(p.content); err != nil {
+					return err
+				}
+				write(`</text:p></text:note-body></text:note>`)
+			case docAdmonition:
+				// all paragraphs of the admonition have its style, the first
+				// one is its title
+				endParagraph()
+				paragraphStyle = odtAdmonitionStyle(p.kind)
+				startParagraph()
+				write(odtStyled(odtText(p.kind.title()), styleBold))
+				endParagraph()
+				if err := writeParts(p.content); err != nil {
+					return err
+				}
+				endParagraph()
+				paragraphStyle = "Text_20_body"
+			default:
+				return fmt.Errorf("error generating ODT: unhandled document part: %T", p)
+			}
+		}
+		return nil
+	}
+	if err := writeParts(doc); err != nil {
+		return nil, err
+	}
+	endParagraph()
+
+	var manifest bytes.Buffer
+	for _, pic := range pictures {
+		fmt.Fprintf(&manifest, `<manifest:file-entry manifest:full-path="%s" manifest:media-type="image/png"/>`, pic.file)
+	}
+
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	// the mimetype must be the first file and it must not be compressed
+	mimetype, err := z.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := mimetype.Write([]byte(odtMimeType)); err != nil {
+		return nil, err
+	}
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"META-INF/manifest.xml", fmt.Sprintf(odtManifest, manifest.String())},
+		{"meta.xml", fmt.Sprintf(odtMeta, xmlEscape(doc.title))},
+		{"styles.xml", odtStyles},
+		{"content.xml", xmlHeader + `<office:document-content` + odtNamespaces + ` office:version="1.2">` +
+			`<office:automatic-styles/>` +
+			`<office:body><office:text>` + body.String() + `</office:text></office:body>` +
+			`</office:document-content>`},
+	}
+	for _, file := range files {
+		w, err := z.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(file.content)); err != nil {
+			return nil, err
+		}
+	}
+	for _, pic := range pictures {
+		// PNGs are already compressed
+		w, err := z.CreateHeader(&zip.FileHeader{Name: pic.file, Method: zip.Store})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(pic.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// odtText escapes the text and keeps its white space, which ODF would
+// otherwise collapse into single spaces.
+func odtText(s string) string {
+	var buf bytes.Buffer
+	spaces := 0
+	flushSpaces := func() {
+		if spaces > 0 {
+			buf.WriteByte(' ')
+		}
+		if spaces > 1 {
+			fmt.Fprintf(&buf, `<text:s text:c="%d"/>`, spaces-1)
+		}
+		spaces = 0
+	}
+	for _, r := range s {
+		if r == ' ' {
+			spaces++
+			continue
+		}
+		flushSpaces()
+		switch r {
+		case '\t':
+			buf.WriteString("<text:tab/>")
+		case '\n':
+			buf.WriteString("<text:line-break/>")
+		default:
+			buf.WriteString(xmlEscape(string(r)))
+		}
+	}
+	flushSpaces()
+	return buf.String()
+}
+
+const odtMimeType = "application/vnd.oasis.opendocument.text"
+
+const odtNamespaces = ` xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0"` +
+	` xmlns:style="urn:oasis:names:tc:opendocument:xmlns:style:1.0"` +
+	` xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0"` +
+	` xmlns:draw="urn:oasis:names:tc:opendocument:xmlns:drawing:1.0"` +
+	` xmlns:fo="urn:oasis:names:tc:opendocument:xmlns:xsl-fo-compatible:1.0"` +
+	` xmlns:svg="urn:oasis:names:tc:opendocument:xmlns:svg-compatible:1.0"` +
+	` xmlns:xlink="http://www.w3.org/1999/xlink"` +
+	` xmlns:dc="http://purl.org/dc/elements/1.1/"` +
+	` xmlns:meta="urn:oasis:names:tc:opendocument:xmlns:meta:1.0"`
+
+const odtManifest = xmlHeader + `<manifest:manifest xmlns:manifest="urn:oasis:names:tc:opendocument:xmlns:manifest:1.0" manifest:version="1.2">` +
+	`<manifest:file-entry manifest:full-path="/" manifest:version="1.2" manifest:media-type="` + odtMimeType + `"/>` +
+	`<manifest:file-entry manifest:full-path="content.xml" manifest:media-type="text/xml"/>` +
+	`<manifest:file-entry manifest:full-path="styles.xml" manifest:media-type="text/xml"/>` +
+	`<manifest:file-entry manifest:full-path="meta.xml" manifest:media-type="text/xml"/>` +
+	`%s</manifest:manifest>`
+
+const odtMeta = xmlHeader + `<office:document-meta` + odtNamespaces + ` office:version="1.2">` +
+	`<office:meta><dc:title>%s</dc:title></office:meta></office:document-meta>`
+
+// odtStyleSpans are the text styles in odtStyles, from the innermost to the
+// outermost span.
+var odtStyleSpans = []struct {
+	style textStyle
+	name  string
+}{
+	{styleHighlight, "Highlight"},
+	{styleSub, "Subscript"},
+	{styleSuper, "Superscript"},
+	{styleStrike, "Strikethrough"},
+	{styleUnderline, "Underline"},
+	{styleItalic, "Italic"},
+	{styleBold, "Bold"},
+}
+
+// odtStyled puts the text in nested spans, one for every style.
+func odtStyled(s string, style textStyle) string {
+	for _, span := range odtStyleSpans {
+		if style.has(span.style) {
+			s = `<text:span text:style-name="` + span.name + `">` + s + `</text:span>`
+		}
+	}
+	return s
+}
+
+// odtAdmonitionStyle returns the name of the paragraph style of the
+// admonition, e.g. "Warning".
+func odtAdmonitionStyle(kind admonitionKind) string {
+	return kind.title()
+}
+
+// odtAdmonitionStyles defines the paragraph styles of the admonitions with the
+// same colors as in RTF. Consecutive paragraphs with the same borders share
+// one border.
+func odtAdmonitionStyles() string {
+	var styles string
+	for _, c := range rtfAdmonitionColors {
+		styles += fmt.Sprintf(`<style:style style:name="%s" style:family="paragraph" style:parent-style-name="Text_20_body" style:class="text">`+
+			`<style:paragraph-properties fo:margin-left="0.4cm" fo:margin-right="0.4cm" fo:margin-bottom="0cm" fo:padding="0.2cm"`+
+			` fo:border-left="2pt solid #%s" fo:background-color="#%s"/></style:style>`,
+			odtAdmonitionStyle(c.kind), c.border.hex(), c.background.hex(),
+		)
+	}
+	return styles
+}
+
+// odtStyles has the same heading styles as the RTF style sheet, the page is
+// A4 with 2 cm margins.
+var odtStyles = xmlHeader + `<office:document-styles` + odtNamespaces + ` office:version="1.2">` +
+	// the fonts that the styles use must be declared
+	`<office:font-face-decls>` +
+	`<style:font-face style:name="Calibri" svg:font-family="Calibri" style:font-family-generic="swiss" style:font-pitch="variable"/>` +
+	`<style:font-face style:name="Consolas" svg:font-family="Consolas" style:font-family-generic="modern" style:font-pitch="fixed"/>` +
+	`</office:font-face-decls>` +
+	`<office:styles>` +
+	`<style:default-style style:family="paragraph"><style:text-properties style:font-name="Calibri" fo:font-family="Calibri" fo:font-size="11pt"/></style:default-style>` +
+	`<style:style style:name="Standard" style:family="paragraph" style:class="text"/>` +
+	`<style:style style:name="Text_20_body" style:display-name="Text body" style:family="paragraph" style:parent-style-name="Standard" style:class="text">` +
+	`<style:paragraph-properties fo:margin-top="0cm" fo:margin-bottom="0.212cm"/></style:style>` +
+	`<style:style style:name="Heading" style:family="paragraph" style:parent-style-name="Standard" style:next-style-name="Text_20_body" style:class="text">` +
+	`<style:paragraph-properties fo:margin-top="0.423cm" fo:margin-bottom="0.106cm" fo:keep-with-next="always"/>` +
+	`<style:text-properties fo:font-weight="bold"/></style:style>` +
+	`<style:style style:name="Heading_20_1" style:display-name="Heading 1" style:family="paragraph" style:parent-style-name="Heading" style:default-outline-level="1" style:class="text">` +
+	`<style:text-properties fo:font-size="22.5pt"/></style:style>` +
+	`<style:style style:name="Heading_20_2" style:display-name="Heading 2" style:family="paragraph" style:parent-style-name="Heading" style:default-outline-level="2" style:class="text">` +
+	`<style:text-properties fo:font-size="20pt"/></style:style>` +
+	`<style:style style:name="Heading_20_3" style:display-name="Heading 3" style:family="paragraph" style:parent-style-name="Heading" style:default-outline-level="3" style:class="text">` +
+	`<style:text-properties fo:font-size="17pt"/></style:style>` +
+	`<style:style style:name="Heading_20_4" style:display-name="Heading 4" style:family="paragraph" style:parent-style-name="Heading" style:default-outline-level="4" style:class="text">` +
+	`<style:text-properties fo:font-size="11pt"/></style:style>` +
+	`<style:style style:name="Footnote" style:family="paragraph" style:parent-style-name="Standard" style:class="extra">` +
+	`<style:paragraph-properties fo:margin-left="0.5cm" fo:text-indent="-0.5cm"/><style:text-properties fo:font-size="10pt"/></style:style>` +
+	`<style:style style:name="Bold" style:family="text"><style:text-properties fo:font-weight="bold"/></style:style>` +
+	`<style:style style:name="Italic" style:family="text"><style:text-properties fo:font-style="italic"/></style:style>` +
+	`<style:style style:name="Underline" style:family="text"><style:text-properties style:text-underline-style="solid" style:text-underline-width="auto" style:text-underline-color="font-color"/></style:style>` +
+	`<style:style style:name="Strikethrough" style:family="text"><style:text-properties style:text-line-through-style="solid"/></style:style>` +
+	`<style:style style:name="Superscript" style:family="text"><style:text-properties style:text-position="super 58%"/></style:style>` +
+	`<style:style style:name="Subscript" style:family="text"><style:text-properties style:text-position="sub 58%"/></style:style>` +
+	`<style:style style:name="Highlight" style:family="text"><style:text-properties fo:background-color="#ffff00"/></style:style>` +
+	`<style:style style:name="Code" style:family="text"><style:text-properties style:font-name="Consolas" fo:font-family="Consolas"/></style:style>` +
+	`<style:style style:name="Key" style:family="text" style:parent-style-name="Code">` +
+	`<style:text-properties fo:font-size="10pt" fo:border="0.5pt solid #808080" fo:padding="0.05cm"/></style:style>` +
+	odtAdmonitionStyles() +
+	`</office:styles>` +
+	`<office:automatic-styles><style:page-layout style:name="pm1">` +
+	`<style:page-layout-properties fo:page-width="21cm" fo:page-height="29.7cm" fo:margin-top="2cm" fo:margin-bottom="2cm" fo:margin-left="2cm" fo:margin-right="2cm"/>` +
+	`</style:page-layout></office:automatic-styles>` +
+	`<office:master-styles><style:master-page style:name="Standard" style:page-layout-name="pm1"/></office:master-styles>` +
+	`</office:document-styles>`
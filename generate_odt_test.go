@@ -0,0 +1,126 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestODTPackage(t *testing.T) {
+	files := genTestODT(t, `=====
+Title
+=====
+See [Two] and [the web[https://example.com/?a=1&b=2]].
+Two
+===
+*bold* and /italic/ text.`)
+
+	if files[0].name != "mimetype" || files[0].content != "application/vnd.oasis.opendocument.text" {
+		t.Fatal("the first file must be the mimetype")
+	}
+	byName := make(map[string]string)
+	for _, f := range files {
+		byName[f.name] = f.content
+	}
+	for _, name := range []string{
+		"META-INF/manifest.xml",
+		"meta.xml",
+		"styles.xml",
+		"content.xml",
+	} {
+		content, ok := byName[name]
+		if !ok {
+			t.Errorf("missing file %s", name)
+		}
+		checkWellFormedXML(t, name, content)
+	}
+	for _, check := range []struct{ file, want string }{
+		{"content.xml", `<text:h text:style-name="Heading_20_1" text:outline-level="1">` +
+			`<text:bookmark-start text:name="_title"/>Title<text:bookmark-end text:name="_title"/></text:h>`},
+		{"content.xml", `<text:a xlink:type="simple" xlink:href="#_two">Two</text:a>`},
+		{"content.xml", `<text:a xlink:type="simple" xlink:href="https://example.com/?a=1&amp;b=2">the web</text:a>`},
+		{"content.xml", `<text:span text:style-name="Bold">bold</text:span>`},
+		{"content.xml", `<text:span text:style-name="Italic">italic</text:span>`},
+		{"meta.xml", `<dc:title>Title</dc:title>`},
+	} {
+		if !strings.Contains(byName[check.file], check.want) {
+			t.Errorf("%s does not contain\n%s\n%s", check.file, check.want, byName[check.file])
+		}
+	}
+}
+
+func TestODTKeepsWhiteSpace(t *testing.T) {
+	for text, want := range map[string]string{
+		"a  b\tc":    `a <text:s text:c="1"/>b<text:tab/>c`,
+		"a    b":     `a <text:s text:c="3"/>b`,
+		"<&>":        `&lt;&amp;&gt;`,
+		"line\nline": `line<text:line-break/>line`,
+	} {
+		if got := odtText(text); got != want {
+			t.Errorf("%q: want\n%s\nbut have\n%s", text, want, got)
+		}
+	}
+}
+
+func TestODTFontsAreDeclared(t *testing.T) {
+	used := regexp.MustCompile(`style:font-name="([^"]*)"`).FindAllStringSubmatch(odtStyles, -1)
+	if len(used) == 0 {
+		t.Fatal("the styles use no fonts")
+	}
+	for _, font := range used {
+		if !strings.Contains(odtStyles, `<style:font-face style:name="`+font[1]+`"`) {
+			t.Errorf("font %s is not declared", font[1])
+		}
+	}
+}
+
+func TestODTFramesHaveUniqueNames(t *testing.T) {
+	imageCache["a.png"] = image.NewRGBA(image.Rect(0, 0, 2, 2))
+	defer delete(imageCache, "a.png")
+	for _, f := range genTestODT(t, "[a.png][a.png]") {
+		if f.name == "content.xml" {
+			if !strings.Contains(f.content, `draw:name="Image1"`) || !strings.Contains(f.content, `draw:name="Image2"`) {
+				t.Errorf("frames must be numbered:\n%s", f.content)
+			}
+		}
+	}
+}
+
+type zipFile struct {
+	name    string
+	content string
+}
+
+func genTestODT(t *testing.T, code string) []zipFile {
+	t.Helper()
+	doc, err := parse([]byte(code))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	odt, err := genODT(doc)
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(odt), int64(len(odt)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []zipFile
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, zipFile{f.Name, string(data)})
+	}
+	return files
+}
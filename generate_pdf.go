@@ -0,0 +1,772 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"unicode"
+	"unicode/utf16"
+)
+
+// Page geometry in points, the page is A4 with 20 mm margins.
+const (
+	pdfPageWidth    = 595.28
+	pdfPageHeight   = 841.89
+	pdfMargin       = 56.69
+	pdfContentWidth = pdfPageWidth - 2*pdfMargin
+	pdfTextSize     = 11.0
+	pdfLineHeight   = 1.4 // times the font size
+	// pdfPixelSize is the size of an image pixel in points, images are
+	// assumed to have 96 DPI
+	pdfPixelSize = 72.0 / 96.0
+)
+
+// pdfHeadingSizes are the font sizes of the title and the caption levels.
+var pdfHeadingSizes = [4]float64{24, 20, 16, 13}
+
+func genPDF(doc document) ([]byte, error) {
+	l := newPDFLayout()
+	if err := l.addParts(doc); err != nil {
+		return nil, err
+	}
+	l.endParagraph()
+	if err := l.addFootnotes(); err != nil {
+		return nil, err
+	}
+	return l.write(doc.title), nil
+}
+
+// addParts lays out the parts of the document, it is called again for the
+// content of admonitions and footnotes.
+func (l *pdfLayout) addParts(doc document) error {
+	for i, part := range doc.parts {
+		switch p := part.(type) {
+		case docText:
+			l.addText(string(p), helvetica, pdfTextSize, pdfLinkTarget{})
+		case docParagraphBreak:
+			l.endParagraph()
+		case docLineBreak:
+			l.words = append(l.words, pdfWord{lineBreak: true})
+		case docImage:
+			if err := l.addImage(p.name); err != nil {
+				return doc.errorAt(i, err)
+			}
+		case docTitle:
+			l.addHeading(heading(p), 1)
+		case docCaption:
+			l.addHeading(heading(p), 2)
+		case docSubCaption:
+			l.addHeading(heading(p), 3)
+		case docSubSubCaption:
+			l.addHeading(heading(p), 4)
+		case docLink:
+			l.addStyledText(p.text, p.style, pdfLinkTarget{dest: p.id})
+		case externalDocLink:
+			l.addStyledText(p.text, p.style, pdfLinkTarget{uri: p.url})
+		case stylizedDocText:
+			l.addStyledText(p.text, p.style, pdfLinkTarget{})
+		case docCode:
+			l.addText(string(p), courier, pdfTextSize, pdfLinkTarget{})
+		case docKey:
+			l.addText(string(p), courierBold, pdfTextSize, pdfLinkTarget{})
+		case docFootnote:
+			l.addFootnoteRef(p.number)
+			l.notes = append(l.notes, p)
+		case docAdmonition:
+			l.endParagraph()
+			start := l.startAdmonition()
+			l.addText(p.kind.title(), helveticaBold, pdfTextSize, pdfLinkTarget{})
+			l.endParagraph()
+			if err := l.addParts(p.content); err != nil {
+				return err
+			}
+			l.endParagraph()
+			l.endAdmonition(p.kind, start)
+		default:
+			return fmt.Errorf("error generating PDF: unhandled document part: %T", p)
+		}
+	}
+	return nil
+}
+
+// pdfLayout places the document contents on pages. Text is collected into
+// words until the paragraph ends, then it is wrapped into lines.
+type pdfLayout struct {
+	pages []*pdfPage
+	// y is the top of the free space on the current page, measured from the
+	// bottom of the page like all PDF coordinates
+	y float64
+
+	// words of the current paragraph, space is true if a space has to be
+	// inserted before the next word
+	words []pdfWord
+	space bool
+	// indent is the space left of the text, inside admonitions
+	indent float64
+	// notes are the footnotes, they are placed after the text
+	notes []docFootnote
+
+	images     []image.Image
+	imageIndex map[string]int
+	// dests are the positions of the headings by their ids
+	dests   map[string]pdfDest
+	outline []pdfOutlineItem
+}
+
+type pdfPage struct {
+	content bytes.Buffer
+	links   []pdfLink
+}
+
+type pdfDest struct {
+	page int
+	y    float64
+}
+
+type pdfLinkTarget struct {
+	dest string // id of a heading for internal links
+	uri  string // external links
+}
+
+func (t pdfLinkTarget) isLink() bool {
+	return t != pdfLinkTarget{}
+}
+
+type pdfLink struct {
+	x0, y0, x1, y1 float64
+	target         pdfLinkTarget
+}
+
+type pdfWord struct {
+	text []byte // WinAnsi encoded
+	font pdfFont
+	size float64
+	link pdfLinkTarget
+	// space is true if there is a space between this and the previous word,
+	// otherwise the words must not be separated by a line break
+	space bool
+	// lineBreak words have no text, the next word starts on a new line
+	lineBreak bool
+	// rise lifts the word above the baseline, for superscripts and footnote
+	// numbers, or lowers it if it is negative, for subscripts
+	rise float64
+	// style is the text style, writeLine draws the lines of underlined and
+	// struck through text and the background of highlighted text
+	style textStyle
+}
+
+type pdfOutlineItem struct {
+	title string
+	level int
+	dest  pdfDest
+}
+
+func newPDFLayout() *pdfLayout {
+	l := &pdfLayout{
+		imageIndex: make(map[string]int),
+		dests:      make(map[string]pdfDest),
+	}
+	l.newPage()
+	return l
+}
+
+func (l *pdfLayout) newPage() {
+	l.pages = append(l.pages, &pdfPage{})
+	l.y = pdfPageHeight - pdfMargin
+}
+
+func (l *pdfLayout) page() *pdfPage {
+	return l.pages[len(l.pages)-1]
+}
+
+func (l *pdfLayout) atPageTop() bool {
+	return l.y == pdfPageHeight-pdfMargin
+}
+
+// makeRoom starts a new page if less than height points are left on the
+// current one.
+func (l *pdfLayout) makeRoom(height float64) {
+	if l.y-height < pdfMargin && !l.atPageTop() {
+		l.newPage()
+	}
+}
+
+// addText splits the text into words and adds them to the current paragraph.
+func (l *pdfLayout) addText(text string, font pdfFont, size float64, link pdfLinkTarget) {
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			l.words = append(l.words, pdfWord{
+				text:  toWinAnsi(string(word)),
+				font:  font,
+				size:  size,
+				link:  link,
+				space: l.space && len(l.words) > 0,
+			})
+			word = word[:0]
+			l.space = false
+		}
+	}
+	for _, r := range text {
+		if unicode.IsSpace(r) {
+			flush()
+			l.space = true
+		} else {
+			word = append(word, r)
+		}
+	}
+	flush()
+}
+
+// addStyledText adds text in the font of its style. Super- and subscripts are
+// smaller and raised or lowered, the other styles are drawn by writeLine.
+func (l *pdfLayout) addStyledText(text string, style textStyle, link pdfLinkTarget) {
+	size, rise := pdfTextSize, 0.0
+	if style.has(styleSuper) {
+		size, rise = pdfTextSize*0.7, pdfTextSize*0.35
+	} else if style.has(styleSub) {
+		size, rise = pdfTextSize*0.7, -pdfTextSize*0.15
+	}
+	start := len(l.words)
+	l.addText(text, pdfFontForStyle(style), size, link)
+	for i := start; i < len(l.words); i++ {
+		l.words[i].rise = rise
+		l.words[i].style = style
+	}
+}
+
+func (l *pdfLayout) endParagraph() {
+	if len(l.words) == 0 {
+		return
+	}
+	l.writeLines(l.words)
+	l.words = nil
+	l.space = false
+	l.y -= pdfTextSize / 2
+}
+
+// writeLines wraps the words into lines that fit the page width and writes
+// them to the pages.
+func (l *pdfLayout) writeLines(words []pdfWord) {
+	spaceWidth := func(w pdfWord) float64 {
+		return textWidth([]byte{' '}, w.font, w.size)
+	}
+	start := 0
+	width := 0.0
+	for i := 0; i < len(words); {
+		if words[i].lineBreak {
+			l.writeLine(words[start:i])
+			i++
+			start, width = i, 0
+			continue
+		}
+		// words that are not separated by a space are kept together
+		end := i + 1
+		groupWidth := textWidth(words[i].text, words[i].font, words[i].size)
+		for end < len(words) && !words[end].space && !words[end].lineBreak {
+			groupWidth += textWidth(words[end].text, words[end].font, words[end].size)
+			end++
+		}
+		if i > start && words[i].space {
+			groupWidth += spaceWidth(words[i])
+		}
+		if i > start && width+groupWidth > pdfContentWidth-l.indent {
+			l.writeLine(words[start:i])
+			start, width = i, 0
+			continue
+		}
+		width += groupWidth
+		i = end
+	}
+	if start < len(words) {
+		l.writeLine(words[start:])
+	}
+}
+
+func (l *pdfLayout) writeLine(words []pdfWord) {
+	size := pdfTextSize
+	for _, w := range words {
+		if w.size > size {
+			size = w.size
+		}
+	}
+	height := size * pdfLineHeight
+	l.makeRoom(height)
+	baseline := l.y - size
+	l.y -= height
+
+	page := l.page()
+	x := pdfMargin + l.indent
+	var link *pdfLink
+	for i, w := range words {
+		spaceStart := x
+		if i > 0 && w.space {
+			x += textWidth([]byte{' '}, w.font, w.size)
+		}
+		width := textWidth(w.text, w.font, w.size)
+		// decoration returns the start and width of a line or background, it
+		// also covers the space after a word of the same style
+		decoration := func(style textStyle) (float64, float64) {
+			if i > 0 && w.space && words[i-1].style.has(style) {
+				return spaceStart, x + width - spaceStart
+			}
+			return x, width
+		}
+		if w.style.has(styleHighlight) {
+			x0, width := decoration(styleHighlight)
+			fmt.Fprintf(
+				&page.content,
+				"1 1 0 rg %.2f %.2f %.2f %.2f re f\n",
+				x0, baseline-pdfTextSize*0.25, width, pdfTextSize*1.15,
+			)
+		}
+		color := "0 g"
+		if w.link.isLink() {
+			color = "0 0 0.75 rg"
+		}
+		rise := ""
+		if w.rise != 0 {
+			rise = fmt.Sprintf(" %.2f Ts", w.rise)
+		}
+		fmt.Fprintf(
+			&page.content,
+			"%s BT /F%d %.2f Tf%s %.2f %.2f Td %s Tj ET\n",
+			color, w.font+1, w.size, rise, x, baseline, pdfString(w.text),
+		)
+		// the lines are filled in the text color
+		lineWidth := w.size * 0.06
+		if w.style.has(styleUnderline) {
+			x0, width := decoration(styleUnderline)
+			fmt.Fprintf(
+				&page.content,
+				"%.2f %.2f %.2f %.2f re f\n",
+				x0, baseline+w.rise-w.size*0.12, width, lineWidth,
+			)
+		}
+		if w.style.has(styleStrike) {
+			x0, width := decoration(styleStrike)
+			fmt.Fprintf(
+				&page.content,
+				"%.2f %.2f %.2f %.2f re f\n",
+				x0, baseline+w.rise+w.size*0.28, width, lineWidth,
+			)
+		}
+		if w.link.isLink() {
+			if link != nil && link.target == w.link {
+				link.x1 = x + width
+			} else {
+				page.links = append(page.links, pdfLink{
+					x0:     x,
+					y0:     baseline - size*0.25,
+					x1:     x + width,
+					y1:     baseline + size*0.9,
+					target: w.link,
+				})
+				link = &page.links[len(page.links)-1]
+			}
+		} else {
+			link = nil
+		}
+		x += width
+	}
+}
+
+func (l *pdfLayout) addHeading(h heading, level int) {
+	l.endParagraph()
+	size := pdfHeadingSizes[level-1]
+	if !l.atPageTop() {
+		l.y -= size * 0.6
+	}
+	// keep the heading together with the first lines of the next paragraph
+	l.makeRoom(size*pdfLineHeight + 3*pdfTextSize*pdfLineHeight)
+	dest := pdfDest{page: len(l.pages) - 1, y: l.y + size*0.3}
+	l.dests[h.id] = dest
+	l.outline = append(l.outline, pdfOutlineItem{
+		title: h.text,
+		level: level,
+		dest:  dest,
+	})
+	l.addText(h.text, helveticaBold, size, pdfLinkTarget{})
+	l.writeLines(l.words)
+	l.words = nil
+	l.space = false
+	l.y -= size * 0.3
+}
+
+func (l *pdfLayout) addImage(name string) error {
+	l.endParagraph()
+	img, err := findImage(name)
+	if err != nil {
+		return fmt.Errorf("error generating PDF image '%s': %s", name, err.Error())
+	}
+	index, ok := l.imageIndex[name]
+	if !ok {
+		index = len(l.images)
+		l.images = append(l.images, img)
+		l.imageIndex[name] = index
+	}
+
+	// scale the image down to fit the page
+	w := float64(img.Bounds().Dx()) * pdfPixelSize
+	h := float64(img.Bounds().Dy()) * pdfPixelSize
+	if maxW := pdfContentWidth - l.indent; w > maxW {
+		h *= maxW / w
+		w = maxW
+	}
+	if maxH := pdfPageHeight - 2*pdfMargin; h > maxH {
+		w *= maxH / h
+		h = maxH
+	}
+	l.makeRoom(h)
+	l.y -= h
+	fmt.Fprintf(
+		&l.page().content,
+		"q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n",
+		w, h, pdfMargin+l.indent, l.y, index+1,
+	)
+	l.y -= pdfTextSize / 2
+	return nil
+}
+
+// addFootnoteRef adds the raised number of a footnote to the current
+// paragraph, it links to the note at the end of the document.
+func (l *pdfLayout) addFootnoteRef(number int) {
+	l.words = append(l.words, pdfWord{
+		text: toWinAnsi(strconv.Itoa(number)),
+		font: helvetica,
+		size: pdfTextSize * 0.7,
+		link: pdfLinkTarget{dest: pdfFootnoteDest(number)},
+		rise: pdfTextSize * 0.35,
+	})
+	l.space = false
+}
+
+// addFootnotes lays out the footnotes below a short line after the text.
+func (l *pdfLayout) addFootnotes() error {
+	if len(l.notes) == 0 {
+		return nil
+	}
+	l.makeRoom(2 * pdfTextSize * pdfLineHeight)
+	l.y -= pdfTextSize / 2
+	fmt.Fprintf(&l.page().content, "0.5 g %.2f %.2f %.2f 0.5 re f\n", pdfMargin, l.y, pdfContentWidth/3)
+	l.y -= pdfTextSize / 2
+	for _, note := range l.notes {
+		l.makeRoom(pdfTextSize * pdfLineHeight)
+		l.dests[pdfFootnoteDest(note.number)] = pdfDest{page: len(l.pages) - 1, y: l.y}
+		l.addText(fmt.Sprintf("%d.", note.number), helvetica, pdfTextSize, pdfLinkTarget{})
+		if err := l.addParts(note.content); err != nil {
+			return err
+		}
+		l.endParagraph()
+	}
+	return nil
+}
+
+// pdfFootnoteDest is the link target of a footnote, it cannot collide with
+// the ids of headings.
+func pdfFootnoteDest(number int) string {
+	return fmt.Sprintf("fn:%d", number)
+}
+
+// pdfAdmonitionIndent is the indentation of the text in admonitions, the bar
+// left of the text is pdfAdmonitionBar points wide.
+const (
+	pdfAdmonitionIndent = 12.0
+	pdfAdmonitionBar    = 3.0
+)
+
+// startAdmonition indents the following text and returns where the admonition
+// starts, see endAdmonition.
+func (l *pdfLayout) startAdmonition() pdfDest {
+	l.indent = pdfAdmonitionIndent
+	return pdfDest{page: len(l.pages) - 1, y: l.y}
+}
+
+// endAdmonition ends the indentation and draws a bar in the admonition's color
+// left of its text, on every page that it spans.
+func (l *pdfLayout) endAdmonition(kind admonitionKind, start pdfDest) {
+	l.indent = 0
+	color := "0.5 g"
+	for _, c := range rtfAdmonitionColors {
+		if c.kind == kind {
+			color = fmt.Sprintf("%.3f %.3f %.3f rg", float64(c.border.r)/255, float64(c.border.g)/255, float64(c.border.b)/255)
+		}
+	}
+	for page := start.page; page < len(l.pages); page++ {
+		top, bottom := pdfPageHeight-pdfMargin, pdfMargin
+		if page == start.page {
+			top = start.y
+		}
+		if page == len(l.pages)-1 {
+			// endParagraph left space below the last paragraph
+			bottom = l.y + pdfTextSize/2
+		}
+		if top > bottom {
+			fmt.Fprintf(
+				&l.pages[page].content,
+				"%s %.2f %.2f %.2f %.2f re f\n",
+				color, pdfMargin, bottom, pdfAdmonitionBar, top-bottom,
+			)
+		}
+	}
+}
+
+// write creates the PDF file from the laid out pages.
+func (l *pdfLayout) write(title string) []byte {
+	var w pdfWriter
+	catalog, pages := w.newObject(), w.newObject()
+
+	fonts := make([]int, pdfFontCount)
+	for i := range fonts {
+		fonts[i] = w.newObject()
+		w.writeObject(fonts[i], fmt.Sprintf(
+			"<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>",
+			pdfFontNames[i],
+		))
+	}
+	var resources bytes.Buffer
+	resources.WriteString("<< /Font <<")
+	for i, id := range fonts {
+		fmt.Fprintf(&resources, " /F%d %d 0 R", i+1, id)
+	}
+	resources.WriteString(" >>")
+	if len(l.images) > 0 {
+		resources.WriteString(" /XObject <<")
+		for i, img := range l.images {
+			id := w.newObject()
+			b := img.Bounds()
+			w.writeStream(id, fmt.Sprintf(
+				"/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8",
+				b.Dx(), b.Dy(),
+			), rgbOnWhite(img))
+			fmt.Fprintf(&resources, " /Im%d %d 0 R", i+1, id)
+		}
+		resources.WriteString(" >>")
+	}
+	resources.WriteString(" >>")
+
+	pageIDs := make([]int, len(l.pages))
+	for i := range pageIDs {
+		pageIDs[i] = w.newObject()
+	}
+	destArray := func(d pdfDest) string {
+		return fmt.Sprintf("[%d 0 R /XYZ %.2f %.2f null]", pageIDs[d.page], pdfMargin, d.y)
+	}
+	for i, page := range l.pages {
+		var annots bytes.Buffer
+		for _, link := range page.links {
+			action := ""
+			if link.target.uri != "" {
+				action = "/A << /S /URI /URI " + pdfString([]byte(link.target.uri)) + " >>"
+			} else if dest, ok := l.dests[link.target.dest]; ok {
+				action = "/Dest " + destArray(dest)
+			} else {
+				continue
+			}
+			id := w.newObject()
+			w.writeObject(id, fmt.Sprintf(
+				"<< /Type /Annot /Subtype /Link /Rect [%.2f %.2f %.2f %.2f] /Border [0 0 0] %s >>",
+				link.x0, link.y0, link.x1, link.y1, action,
+			))
+			fmt.Fprintf(&annots, " %d 0 R", id)
+		}
+		content := w.newObject()
+		w.writeStream(content, "", page.content.Bytes())
+		pageDict := fmt.Sprintf(
+			"<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources %s /Contents %d 0 R",
+			pages, pdfPageWidth, pdfPageHeight, resources.String(), content,
+		)
+		if annots.Len() > 0 {
+			pageDict += " /Annots [" + annots.String() + " ]"
+		}
+		w.writeObject(pageIDs[i], pageDict+" >>")
+	}
+	var kids bytes.Buffer
+	for _, id := range pageIDs {
+		fmt.Fprintf(&kids, " %d 0 R", id)
+	}
+	w.writeObject(pages, fmt.Sprintf("<< /Type /Pages /Kids [%s ] /Count %d >>", kids.String(), len(pageIDs)))
+
+	outlines := l.writeOutline(&w, destArray)
+	if outlines != 0 {
+		w.writeObject(catalog, fmt.Sprintf(
+			"<< /Type /Catalog /Pages %d 0 R /Outlines %d 0 R /PageMode /UseOutlines >>",
+			pages, outlines,
+		))
+	} else {
+		w.writeObject(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages))
+	}
+
+	info := 0
+	if title != "" {
+		info = w.newObject()
+		w.writeObject(info, "<< /Title "+pdfTextString(title)+" /Producer (helpgen) >>")
+	}
+	return w.finish(catalog, info)
+}
+
+// writeOutline writes the bookmarks for all headings, nested by their level,
+// and returns the object number of the outline dictionary, or 0 if there are
+// no headings.
+func (l *pdfLayout) writeOutline(w *pdfWriter, destArray func(pdfDest) string) int {
+	if len(l.outline) == 0 {
+		return 0
+	}
+
+	type node struct {
+		item     pdfOutlineItem
+		id       int
+		children []*node
+	}
+	root := &node{id: w.newObject()}
+	stack := []*node{root}
+	for _, item := range l.outline {
+		for len(stack) > 1 && stack[len(stack)-1].item.level >= item.level {
+			stack = stack[:len(stack)-1]
+		}
+		n := &node{item: item, id: w.newObject()}
+		parent := stack[len(stack)-1]
+		parent.children = append(parent.children, n)
+		stack = append(stack, n)
+	}
+
+	var count func(n *node) int
+	count = func(n *node) int {
+		c := len(n.children)
+		for _, child := range n.children {
+			c += count(child)
+		}
+		return c
+	}
+	var writeChildren func(parent *node)
+	writeChildren = func(parent *node) {
+		for i, n := range parent.children {
+			dict := fmt.Sprintf(
+				"<< /Title %s /Parent %d 0 R /Dest %s",
+				pdfTextString(n.item.title), parent.id, destArray(n.item.dest),
+			)
+			if i > 0 {
+				dict += fmt.Sprintf(" /Prev %d 0 R", parent.children[i-1].id)
+			}
+			if i+1 < len(parent.children) {
+				dict += fmt.Sprintf(" /Next %d 0 R", parent.children[i+1].id)
+			}
+			if len(n.children) > 0 {
+				dict += fmt.Sprintf(
+					" /First %d 0 R /Last %d 0 R /Count %d",
+					n.children[0].id, n.children[len(n.children)-1].id, count(n),
+				)
+			}
+			w.writeObject(n.id, dict+" >>")
+			writeChildren(n)
+		}
+	}
+	writeChildren(root)
+	w.writeObject(root.id, fmt.Sprintf(
+		"<< /Type /Outlines /First %d 0 R /Last %d 0 R /Count %d >>",
+		root.children[0].id, root.children[len(root.children)-1].id, count(root),
+	))
+	return root.id
+}
+
+// pdfWriter writes numbered objects and keeps track of their offsets for the
+// cross-reference table.
+type pdfWriter struct {
+	buf     bytes.Buffer
+	offsets []int
+}
+
+func (w *pdfWriter) newObject() int {
+	if w.buf.Len() == 0 {
+		w.buf.WriteString("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+	}
+	w.offsets = append(w.offsets, 0)
+	return len(w.offsets)
+}
+
+func (w *pdfWriter) writeObject(id int, content string) {
+	w.offsets[id-1] = w.buf.Len()
+	fmt.Fprintf(&w.buf, "%d 0 obj\n%s\nendobj\n", id, content)
+}
+
+// writeStream writes a compressed stream object, dict are the dictionary
+// entries besides the length and filter.
+func (w *pdfWriter) writeStream(id int, dict string, data []byte) {
+	var compressed bytes.Buffer
+	z := zlib.NewWriter(&compressed)
+	z.Write(data)
+	z.Close()
+	w.offsets[id-1] = w.buf.Len()
+	fmt.Fprintf(
+		&w.buf,
+		"%d 0 obj\n<< %s /Length %d /Filter /FlateDecode >>\nstream\n",
+		id, dict, compressed.Len(),
+	)
+	w.buf.Write(compressed.Bytes())
+	w.buf.WriteString("\nendstream\nendobj\n")
+}
+
+func (w *pdfWriter) finish(root, info int) []byte {
+	xref := w.buf.Len()
+	fmt.Fprintf(&w.buf, "xref\n0 %d\n0000000000 65535 f \n", len(w.offsets)+1)
+	for _, offset := range w.offsets {
+		fmt.Fprintf(&w.buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&w.buf, "trailer\n<< /Size %d /Root %d 0 R", len(w.offsets)+1, root)
+	if info != 0 {
+		fmt.Fprintf(&w.buf, " /Info %d 0 R", info)
+	}
+	fmt.Fprintf(&w.buf, " >>\nstartxref\n%d\n%%%%EOF\n", xref)
+	return w.buf.Bytes()
+}
+
+// pdfString creates a literal string, escaping parentheses, backslashes and
+// all non-printable bytes.
+func pdfString(b []byte) string {
+	var buf bytes.Buffer
+	buf.WriteByte('(')
+	for _, c := range b {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < 32 || c >= 127:
+			fmt.Fprintf(&buf, "\\%03o", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+// pdfTextString encodes text that is displayed by the PDF reader outside of
+// the page contents, e.g. bookmarks, in UTF-16 so it can contain any
+// characters.
+func pdfTextString(s string) string {
+	var buf bytes.Buffer
+	buf.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&buf, "%04X", u)
+	}
+	buf.WriteByte('>')
+	return buf.String()
+}
+
+// rgbOnWhite returns the RGB bytes of the image, transparent parts are drawn
+// on a white background.
+func rgbOnWhite(img image.Image) []byte {
+	b := img.Bounds()
+	rgb := make([]byte, 0, b.Dx()*b.Dy()*3)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			white := 255 - c.A
+			rgb = append(rgb, c.R+white, c.G+white, c.B+white)
+		}
+	}
+	return rgb
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPDFCrossReferencesPointToObjects(t *testing.T) {
+	pdf := genTestPDF(t, "text")
+	xrefStart := bytes.LastIndex(pdf, []byte("startxref\n"))
+	if xrefStart == -1 {
+		t.Fatal("missing startxref")
+	}
+	offset, err := strconv.Atoi(strings.Fields(string(pdf[xrefStart+len("startxref\n"):]))[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pdf[offset:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point to the xref table", offset)
+	}
+	lines := strings.Split(string(pdf[offset:]), "\n")
+	count, _ := strconv.Atoi(strings.Fields(lines[1])[1])
+	for id := 1; id < count; id++ {
+		objOffset, _ := strconv.Atoi(strings.Fields(lines[2+id])[0])
+		want := strconv.Itoa(id) + " 0 obj\n"
+		if !bytes.HasPrefix(pdf[objOffset:], []byte(want)) {
+			t.Errorf("xref entry %d does not point to its object", id)
+		}
+	}
+}
+
+func TestPDFHasOutlineAndLinks(t *testing.T) {
+	pdf := string(genTestPDF(t, `===
+Title
+===
+Chapter
+=======
+See [Sub] and [www.example.com].
+Sub
+---
+text`))
+	for _, want := range []string{
+		"/Outlines",
+		"/Title " + pdfTextString("Title"),
+		"/Title " + pdfTextString("Chapter"),
+		"/Title " + pdfTextString("Sub"),
+		"/Subtype /Link",
+		"/A << /S /URI /URI (http://www.example.com) >>",
+		"/Dest [",
+	} {
+		if !strings.Contains(pdf, want) {
+			t.Errorf("PDF does not contain %s", want)
+		}
+	}
+	// the title is the root of the outline, it contains the chapter which in
+	// turn contains the sub-chapter
+	if !regexp.MustCompile(`/Title ` + pdfTextString("Title") + `[^>]*/Count 2`).MatchString(pdf) {
+		t.Error("title bookmark must contain two bookmarks")
+	}
+}
+
+func TestPDFWrapsLongParagraphs(t *testing.T) {
+	pdf := genTestPDF(t, strings.Repeat("word ", 200))
+	content := pdfContents(t, pdf)
+	lines := strings.Count(content, "(word) Tj")
+	if lines != 200 {
+		t.Fatalf("want 200 words but have %d", lines)
+	}
+	baselines := make(map[string]bool)
+	for _, m := range regexp.MustCompile(`Td \(word\)`).FindAllStringIndex(content, -1) {
+		fields := strings.Fields(content[:m[0]])
+		baselines[fields[len(fields)-1]] = true
+		x, _ := strconv.ParseFloat(fields[len(fields)-2], 64)
+		if x+textWidth([]byte("word"), helvetica, pdfTextSize) > pdfPageWidth-pdfMargin+0.01 {
+			t.Fatalf("word at x=%v exceeds the right margin", x)
+		}
+	}
+	if len(baselines) < 10 {
+		t.Errorf("200 words must be wrapped into many lines, have %d", len(baselines))
+	}
+}
+
+func TestPDFDrawsAllTextStyles(t *testing.T) {
+	content := pdfContents(t, genTestPDF(t, "__under line__ ~~struck~~ ==marked== x^2^ H~2~O"))
+	for _, want := range []string{
+		// the line under the second word also covers the space before it
+		"(under) Tj ET\n56.69 772.88 28.13 0.66 re f\n",
+		"Td (line) Tj ET\n84.82 772.88 20.17 0.66 re f\n",
+		"108.05 774.20 Td (struck) Tj ET\n108.05 777.28 29.34 0.66 re f\n",
+		"1 1 0 rg 140.44 771.45 36.67 12.65 re f\n0 g BT /F1 11.00 Tf 140.44 774.20 Td (marked) Tj ET\n",
+		"BT /F1 7.70 Tf 3.85 Ts 185.68 774.20 Td (2) Tj ET\n",
+		"BT /F1 7.70 Tf -1.65 Ts 200.96 774.20 Td (2) Tj ET\n",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("PDF content does not contain\n%s\nin\n%s", want, content)
+		}
+	}
+}
+
+func genTestPDF(t *testing.T, code string) []byte {
+	t.Helper()
+	doc, err := parse([]byte(code))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	pdf, err := genPDF(doc)
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) {
+		t.Fatal("missing PDF header")
+	}
+	return pdf
+}
+
+// pdfContents returns the decompressed contents of all streams.
+func pdfContents(t *testing.T, pdf []byte) string {
+	t.Helper()
+	var all bytes.Buffer
+	for {
+		start := bytes.Index(pdf, []byte(">>\nstream\n"))
+		if start == -1 {
+			break
+		}
+		pdf = pdf[start+len(">>\nstream\n"):]
+		end := bytes.Index(pdf, []byte("\nendstream"))
+		r, err := zlib.NewReader(bytes.NewReader(pdf[:end]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all.Write(data)
+		pdf = pdf[end:]
+	}
+	return all.String()
+}
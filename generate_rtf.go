@@ -8,7 +8,76 @@ import (
 	"unicode/utf16"
 )
 
+// These are the style numbers in the RTF style sheet. The headings use the
+// numbers 1 to 4 for the title and caption levels.
+const (
+	rtfNormalStyle = 0
+)
+
+// These are the indices into the RTF color table.
+const (
+	rtfLinkColor      = 1
+	rtfHeadingColor   = 2
+	rtfHighlightColor = 3
+)
+
+// rtfHighlight is the background color of highlighted text.
+var rtfHighlight = rtfColor{r: 255, g: 255, b: 0}
+
+// rtfAdmonitionColors are the border and background colors of the
+// admonitions. They come after rtfHighlightColor in the color table, border
+// and background alternate. The other word processor formats use the same
+// colors.
+var rtfAdmonitionColors = []struct {
+	kind               admonitionKind
+	border, background rtfColor
+}{
+	{admonitionNote, rtfColor{0x4A, 0x90, 0xD9}, rtfColor{0xEA, 0xF2, 0xFB}},
+	{admonitionTip, rtfColor{0x3C, 0x9A, 0x5F}, rtfColor{0xE8, 0xF5, 0xEC}},
+	{admonitionWarning, rtfColor{0xD9, 0x9A, 0x1E}, rtfColor{0xFD, 0xF4, 0xE1}},
+	{admonitionDanger, rtfColor{0xD0, 0x45, 0x3A}, rtfColor{0xFB, 0xE9, 0xE7}},
+}
+
+// rtfAdmonitionStyle returns the paragraph formatting of the admonition's
+// paragraphs. They are indented and shaded and have a thick border on the left.
+// Word processors draw one border around consecutive paragraphs with the same
+// borders.
+func rtfAdmonitionStyle(kind admonitionKind) string {
+	border := rtfHighlightColor + 1
+	for i, c := range rtfAdmonitionColors {
+		if c.kind == kind {
+			border += 2 * i
+		}
+	}
+	return fmt.Sprintf(`\li240\ri240\brdrl\brdrs\brdrw40\brsp120\brdrcf%d\cbpat%d`, border, border+1)
+}
+
+// rtfStyleWords are the control words of the text styles.
+var rtfStyleWords = []struct {
+	style textStyle
+	word  string
+}{
+	{styleBold, `\b`},
+	{styleItalic, `\i`},
+	{styleUnderline, `\ul`},
+	{styleStrike, `\strike`},
+	{styleSuper, `\super`},
+	{styleSub, `\sub`},
+	{styleHighlight, fmt.Sprintf(`\highlight%d`, rtfHighlightColor)},
+}
+
+// These are the indices into the RTF font table.
+const (
+	rtfTextFont    = 0
+	rtfHeadingFont = 1
+	rtfMonoFont    = 2
+)
+
 func genRTF(doc document) ([]byte, error) {
+	return genRTFWithOptions(doc, defaultRTFOptions())
+}
+
+func genRTFWithOptions(doc document, opts rtfOptions) ([]byte, error) {
 	hexChars := []byte("0123456789abcdef")
 	const maxImageW = 780
 
@@ -18,99 +87,263 @@ func genRTF(doc document) ([]byte, error) {
 			if r < 128 {
 				buf.WriteByte(byte(r))
 			} else {
-				u := utf16.Encode([]rune{r})
-				if len(u) > 0 {
-					buf.WriteString(fmt.Sprintf(`\u%d?`, int(u[0])))
+				// \u takes a signed 16 bit number, characters outside the
+				// BMP are written as two surrogates
+				for _, u := range utf16.Encode([]rune{r}) {
+					buf.WriteString(fmt.Sprintf(`\u%d?`, int16(u)))
 				}
 			}
 		}
 	}
-	writeCaption := func(cap string, size string) {
-		if size != "" {
-			size = `\fs` + size
+
+	// The style sheet defines a Normal style for text and a heading style
+	// with an outline level for each caption level, so word processors can
+	// show the document structure. A paragraph applies a style with \s and
+	// has to repeat the style's formatting, because RTF readers do not take
+	// it from the style sheet.
+	normalStyle := fmt.Sprintf(`\s%d\sa120\f%d\fs%d`, rtfNormalStyle, rtfTextFont, opts.fontSize)
+	headingStyle := func(level int) string {
+		return fmt.Sprintf(
+			`\s%d\outlinelevel%d\keepn\sb240\sa60\b\f%d\fs%d\cf%d`,
+			level, level-1, rtfHeadingFont, opts.headingSizes[level-1], rtfHeadingColor,
+		)
+	}
+	writeLink := func(fieldInst, text string, style textStyle) {
+		write(fmt.Sprintf(`{\field{\*\fldinst %s}{\fldrslt{\cf%d\ul%s %s}}}`, fieldInst, rtfLinkColor, rtfStyle(style), text))
+	}
+
+	// inParagraph is true if text was written since the last paragraph ended,
+	// paragraphStyle is the style of the next paragraph
+	inParagraph := false
+	paragraphStyle := normalStyle
+	startParagraph := func() {
+		if !inParagraph {
+			write(`\pard\plain` + paragraphStyle + ` `)
 		}
-		write(`\b` + size + ` `)
-		write(escape(cap))
-		write(`\b0\fs22\line `)
-	}
-
-	write(`{\rtf1\ansi\deff0{\fonttbl{\f0\fnil\fcharset0 Calibri;}}`)
-	for _, part := range doc.parts {
-		switch p := part.(type) {
-		case docText:
-			write(escape(string(p)))
-		case docImage:
-			img, err := findImage(p.name)
-			if err != nil {
-				return nil, fmt.Errorf("error generating RTF image '%s': %s", p.name, err.Error())
-			}
-			w, h := img.Bounds().Dx(), img.Bounds().Dy()
-			destW, destH := w, h
-			if destW > maxImageW {
-				scale := maxImageW / float64(destW)
-				destW = maxImageW
-				destH = int(float64(destH)*scale + 0.5)
-			}
-			size := fmt.Sprintf(
-				`\picw%d\pich%d\picwgoal%d\pichgoal%d `,
-				toTwips(w),
-				toTwips(h),
-				toTwips(destW),
-				toTwips(destH),
-			)
-			write(`{\*\shppict{\pict\pngblip` + size)
-			var imgBuf bytes.Buffer
-			err = png.Encode(&imgBuf, img)
-			if err != nil {
-				return nil, fmt.Errorf("error encoding RTF png '%s': %s", p.name, err.Error())
-			}
-			hex := make([]byte, imgBuf.Len()*2)
-			for i, b := range imgBuf.Bytes() {
-				hex[i*2] = hexChars[b&0xF0>>4]
-				hex[i*2+1] = hexChars[b&0x0F]
-			}
-			buf.Write(hex)
-			write("\n}}")
-		case docTitle:
-			writeCaption(string(p), "45")
-		case docCaption:
-			writeCaption(string(p), "40")
-		case docSubCaption:
-			writeCaption(string(p), "34")
-		case docSubSubCaption:
-			writeCaption(string(p), "")
-		case docLink:
-			write(escape(string(p.text)))
-		case docLinkTarget:
-			// NOTE there are no links in RTF
-		case externalDocLink:
-			write(fmt.Sprintf(`{\field{\*\fldinst HYPERLINK "%s"}{\fldrslt %s}}`, p.url, escape(p.text)))
-		case stylizedDocText:
-			if p.bold {
-				write(`\b `)
-			}
-			if p.italic {
-				write(`\i `)
-			}
-			write(escape(p.text))
-			if p.italic {
-				write(`\i0 `)
+		inParagraph = true
+	}
+	endParagraph := func() {
+		if inParagraph {
+			write(`\par` + "\n")
+		}
+		inParagraph = false
+	}
+	bookmarks := bookmarkNames(doc)
+	writeCaption := func(cap heading, level int) {
+		endParagraph()
+		write(`\pard\plain` + headingStyle(level) + ` `)
+		bookmark := bookmarks[cap.id]
+		write(`{\*\bkmkstart ` + bookmark + `}{\*\bkmkend ` + bookmark + `}`)
+		write(escape(cap.text))
+		write(`\par` + "\n")
+	}
+
+	write(`{\rtf1\ansi\deff0`)
+	write(`{\fonttbl`)
+	for i, font := range []string{opts.font, opts.headingFont, opts.monoFont} {
+		family := `\fnil`
+		if i == rtfMonoFont {
+			family = `\fmodern`
+		}
+		write(fmt.Sprintf(`{\f%d%s\fcharset0 %s;}`, i, family, escape(font)))
+	}
+	write("}\n")
+	write(`{\colortbl;`)
+	colors := []rtfColor{opts.linkColor, opts.headingColor, rtfHighlight}
+	for _, c := range rtfAdmonitionColors {
+		colors = append(colors, c.border, c.background)
+	}
+	for _, c := range colors {
+		write(fmt.Sprintf(`\red%d\green%d\blue%d;`, c.r, c.g, c.b))
+	}
+	write("}\n")
+	write(`{\stylesheet{` + normalStyle + ` Normal;}`)
+	for level := 1; level <= 4; level++ {
+		write(fmt.Sprintf(`{%s\sbasedon%d\snext%d heading %d;}`, headingStyle(level), rtfNormalStyle, rtfNormalStyle, level))
+	}
+	write("}\n")
+
+	if opts.paperWidth > 0 && opts.paperHeight > 0 {
+		write(fmt.Sprintf(`\paperw%d\paperh%d`, opts.paperWidth, opts.paperHeight))
+		if opts.paperWidth > opts.paperHeight {
+			write(`\landscape`)
+		}
+	}
+	for _, margin := range []struct {
+		word  string
+		twips int
+	}{
+		{`\margt`, opts.marginTop},
+		{`\margr`, opts.marginRight},
+		{`\margb`, opts.marginBottom},
+		{`\margl`, opts.marginLeft},
+	} {
+		if margin.twips > 0 {
+			write(fmt.Sprintf(`%s%d`, margin.word, margin.twips))
+		}
+	}
+	write("\n")
+	for _, hf := range []struct{ destination, text string }{
+		{`\header`, opts.header},
+		{`\footer`, opts.footer},
+	} {
+		if hf.text != "" {
+			write(fmt.Sprintf(
+				`{%s\pard\plain\qc\f%d\fs%d %s\par}`+"\n",
+				hf.destination, rtfTextFont, opts.fontSize*8/10, pageText(hf.text),
+			))
+		}
+	}
+	// writeParts writes the parts of the document, it is called again for
+	// the content of admonitions and footnotes
+	var writeParts func(doc document) error
+	writeParts = func(doc document) error {
+		for i, part := range doc.parts {
+			switch part.(type) {
+			case docText, docImage, docLink, externalDocLink, stylizedDocText, docCode, docKey, docFootnote:
+				startParagraph()
 			}
-			if p.bold {
-				write(`\b0 `)
+
+			switch p := part.(type) {
+			case docText:
+				write(escape(string(p)))
+			case docParagraphBreak:
+				endParagraph()
+			case docLineBreak:
+				write(`\line `)
+			case docImage:
+				img, err := findImage(p.name)
+				if err != nil {
+					return doc.errorAt(i, fmt.Errorf("error generating RTF image '%s': %s", p.name, err.Error()))
+				}
+				w, h := img.Bounds().Dx(), img.Bounds().Dy()
+				destW, destH := w, h
+				if destW > maxImageW {
+					scale := maxImageW / float64(destW)
+					destW = maxImageW
+					destH = int(float64(destH)*scale + 0.5)
+				}
+				size := fmt.Sprintf(
+					`\picw%d\pich%d\picwgoal%d\pichgoal%d `,
+					toTwips(w),
+					toTwips(h),
+					toTwips(destW),
+					toTwips(destH),
+				)
+				write(`{\*\shppict{\pict\pngblip` + size)
+				var imgBuf bytes.Buffer
+				err = png.Encode(&imgBuf, img)
+				if err != nil {
+					return fmt.Errorf("error encoding RTF png '%s': %s", p.name, err.Error())
+				}
+				hex := make([]byte, imgBuf.Len()*2)
+				for i, b := range imgBuf.Bytes() {
+					hex[i*2] = hexChars[b&0xF0>>4]
+					hex[i*2+1] = hexChars[b&0x0F]
+				}
+				buf.Write(hex)
+				write("\n}}")
+			case docTitle:
+				writeCaption(heading(p), 1)
+			case docCaption:
+				writeCaption(heading(p), 2)
+			case docSubCaption:
+				writeCaption(heading(p), 3)
+			case docSubSubCaption:
+				writeCaption(heading(p), 4)
+			case docLink:
+				writeLink(fmt.Sprintf(`HYPERLINK \\l "%s"`, bookmarks[p.id]), escape(p.text), p.style)
+			case externalDocLink:
+				writeLink(fmt.Sprintf(`HYPERLINK "%s"`, escapeFieldArg(p.url)), escape(p.text), p.style)
+			case stylizedDocText:
+				write(`{` + rtfStyle(p.style) + ` ` + escape(p.text) + `}`)
+			case docCode:
+				write(fmt.Sprintf(`{\f%d %s}`, rtfMonoFont, escape(string(p))))
+			case docKey:
+				// keys are boxed like the caps on a keyboard
+				write(fmt.Sprintf(`{\chbrdr\brdrs\brdrw10\brsp20\f%d\fs%d %s}`, rtfMonoFont, opts.fontSize*9/10, escape(string(p))))
+			case docFootnote:
+				// the footnote's text goes where it is referenced, word
+				// processors number footnotes automatically with \chftn
+				write(fmt.Sprintf(`{\super\chftn}{\footnote\pard\plain%s\fs%d {\super\chftn} `, normalStyle, opts.fontSize*8/10))
+				if err := writeParts(p.content); err != nil {
+					return err
+				}
+				write(`}`)
+			case docAdmonition:
+				// the admonition's paragraphs are shaded and have a border on
+				// the left, the first paragraph is its title
+				endParagraph()
+				paragraphStyle = normalStyle + rtfAdmonitionStyle(p.kind)
+				startParagraph()
+				write(`{\b ` + escape(p.kind.title()) + `}`)
+				endParagraph()
+				if err := writeParts(p.content); err != nil {
+					return err
+				}
+				endParagraph()
+				paragraphStyle = normalStyle
+			default:
+				return fmt.Errorf("error generating RTF: unhandled document part: %T", p)
 			}
-		default:
-			return nil, fmt.Errorf("error generating RTF: unhandled document part: %T", p)
 		}
+		return nil
+	}
+	if err := writeParts(doc); err != nil {
+		return nil, err
 	}
+	endParagraph()
 	write(`}`)
 
 	return buf.Bytes(), nil
 }
 
+// rtfStyle returns the control words that turn on the style.
+func rtfStyle(style textStyle) string {
+	var words string
+	for _, s := range rtfStyleWords {
+		if style.has(s.style) {
+			words += s.word
+		}
+	}
+	return words
+}
+
+var rtfEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`{`, `\{`,
+	`}`, `\}`,
+	"\n", `\line `,
+	"\t", `\tab `,
+)
+
+// escape replaces all characters that have a special meaning in RTF with
+// their control symbols.
 func escape(s string) string {
-	s = strings.Replace(s, "\n", `\line `, -1)
-	return s
+	return rtfEscaper.Replace(s)
+}
+
+var fieldArgEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+)
+
+// escapeFieldArg escapes a quoted argument of a field instruction. Fields
+// have their own escape sequences for backslashes and quotes, the result of
+// which then has to be escaped for RTF.
+func escapeFieldArg(s string) string {
+	return escape(fieldArgEscaper.Replace(s))
+}
+
+var pageFieldReplacer = strings.NewReplacer(
+	`\{page\}`, `{\field{\*\fldinst PAGE}{\fldrslt 1}}`,
+	`\{pages\}`, `{\field{\*\fldinst NUMPAGES}{\fldrslt 1}}`,
+)
+
+// pageText escapes the text of a page header or footer and replaces the
+// placeholders {page} and {pages} with fields for the page number and count.
+func pageText(s string) string {
+	return pageFieldReplacer.Replace(escape(s))
 }
 
 func toTwips(x int) int {
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestRTFSpecialCharactersAreEscaped(t *testing.T) {
+	const tricky = `C:\path {a} "b"`
+	doc := document{parts: []docPart{
+		docCaption{text: tricky, id: "tricky"},
+		docText(tricky),
+		docParagraphBreak{},
+		bold(tricky),
+		docLink{id: "tricky", text: tricky},
+		externalDocLink{url: `http://example.com/{x}\"y"`, text: tricky},
+	}}
+	text, fields := readRTF(t, genRTFString(t, doc))
+	if want := tricky + "\n" + tricky + "\n" + strings.Repeat(tricky, 3); text != want {
+		t.Errorf("want text\n%q\nbut have\n%q", want, text)
+	}
+	wantFields := []string{
+		`HYPERLINK \l "_tricky"`,
+		`HYPERLINK "http://example.com/{x}\\\"y\""`,
+	}
+	if strings.Join(fields, "\n") != strings.Join(wantFields, "\n") {
+		t.Errorf("want fields\n%q\nbut have\n%q", wantFields, fields)
+	}
+}
+
+func TestRTFUnicodeIsWrittenAsSigned16BitValues(t *testing.T) {
+	const text = "äö€ 😀"
+	rtf := genRTFString(t, document{parts: []docPart{docText(text)}})
+	if !strings.Contains(rtf, `\u-10179?\u-8704?`) {
+		t.Errorf("emoji must be written as negative surrogates:\n%s", rtf)
+	}
+	if have, _ := readRTF(t, rtf); have != text {
+		t.Errorf("want %q but have %q", text, have)
+	}
+}
+
+func TestRTFCodeUsesMonoFontAndKeysAreBoxed(t *testing.T) {
+	rtf := genRTFString(t, document{parts: []docPart{docCode(`a\b`), docKey("Esc")}})
+	if !strings.Contains(rtf, `{\f2 a\\b}`) {
+		t.Errorf("code must use the mono font:\n%s", rtf)
+	}
+	if !strings.Contains(rtf, `\chbrdr\brdrs`) {
+		t.Errorf("keys must have a border:\n%s", rtf)
+	}
+	if text, _ := readRTF(t, rtf); text != `a\bEsc` {
+		t.Errorf("unexpected text %q", text)
+	}
+}
+
+func TestRTFTextStylesAreGroups(t *testing.T) {
+	rtf := genRTFString(t, document{parts: []docPart{
+		styled("x", styleBold|styleUnderline|styleHighlight),
+		styled("2", styleSuper),
+		styled("y", styleStrike|styleSub),
+	}})
+	for _, want := range []string{`{\b\ul\highlight3 x}`, `{\super 2}`, `{\strike\sub y}`} {
+		if !strings.Contains(rtf, want) {
+			t.Errorf("RTF does not contain %s:\n%s", want, rtf)
+		}
+	}
+}
+
+func TestRTFLinksCanBeStyled(t *testing.T) {
+	rtf := genRTFString(t, document{parts: []docPart{
+		externalDocLink{url: "http://a.b", text: "link", style: styleBold | styleItalic},
+	}})
+	if !strings.Contains(rtf, `{\fldrslt{\cf1\ul\b\i link}}`) {
+		t.Errorf("link text must be bold and italic:\n%s", rtf)
+	}
+}
+
+func TestRTFAdmonitionsAreShadedAndBordered(t *testing.T) {
+	rtf := genRTFString(t, document{parts: []docPart{
+		docText("a"),
+		docAdmonition{kind: admonitionWarning, content: document{parts: []docPart{
+			docText("b"), docParagraphBreak{}, docText("c"),
+		}}},
+		docText("d"),
+	}})
+	// warnings have the third pair of admonition colors
+	style := `\pard\plain\s0\sa120\f0\fs22\li240\ri240\brdrl\brdrs\brdrw40\brsp120\brdrcf8\cbpat9 `
+	if n := strings.Count(rtf, style); n != 3 {
+		t.Errorf("want 3 shaded paragraphs but have %d:\n%s", n, rtf)
+	}
+	if !strings.Contains(rtf, `\red217\green154\blue30;\red253\green244\blue225;`) {
+		t.Errorf("admonition colors are missing:\n%s", rtf)
+	}
+	if text, _ := readRTF(t, rtf); text != "a\nWarning\nb\nc\nd" {
+		t.Errorf("unexpected text %q", text)
+	}
+}
+
+func TestRTFFootnotesAreNumberedAutomatically(t *testing.T) {
+	rtf := genRTFString(t, document{parts: []docPart{
+		docText("a"),
+		docFootnote{number: 1, content: document{parts: []docPart{docText("note")}}},
+		docText(" b"),
+	}})
+	if !strings.Contains(rtf, `a{\super\chftn}{\footnote\pard\plain`) {
+		t.Errorf("footnote is missing:\n%s", rtf)
+	}
+	if !strings.Contains(rtf, ` {\super\chftn} note}`) {
+		t.Errorf("footnote text is missing:\n%s", rtf)
+	}
+}
+
+func TestRTFCaptionsUseHeadingStyles(t *testing.T) {
+	opts := defaultRTFOptions()
+	opts.headingFont = "Arial"
+	opts.headingSizes[1] = 36
+	output, err := genRTFWithOptions(document{parts: []docPart{
+		docCaption{text: "Caption", id: "caption"},
+		docText("text"),
+	}}, opts)
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	rtf := string(output)
+	for _, want := range []string{
+		`{\f1\fnil\fcharset0 Arial;}`,
+		`{\s2\outlinelevel1\keepn\sb240\sa60\b\f1\fs36\cf2\sbasedon0\snext0 heading 2;}`,
+		`\pard\plain\s2\outlinelevel1\keepn\sb240\sa60\b\f1\fs36\cf2 {\*\bkmkstart _caption}{\*\bkmkend _caption}Caption\par`,
+		`\pard\plain\s0\sa120\f0\fs22 text\par`,
+	} {
+		if !strings.Contains(rtf, want) {
+			t.Errorf("RTF does not contain\n%s\n%s", want, rtf)
+		}
+	}
+	readRTF(t, rtf)
+}
+
+func TestRTFPageSetupAndColors(t *testing.T) {
+	opts := defaultRTFOptions()
+	for name, value := range map[string]string{
+		"paper":      "a4",
+		"margins":    "25.4,10,20,30",
+		"link-color": "#FF8000",
+		"footer":     "Page {page} of {pages}",
+	} {
+		if err := rtfOptionSetters[name](&opts, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output, err := genRTFWithOptions(document{parts: []docPart{
+		externalDocLink{url: "http://a.b", text: "link"},
+	}}, opts)
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	rtf := string(output)
+	for _, want := range []string{
+		// the link, heading and highlight colors and the border and
+		// background colors of the admonitions
+		`{\colortbl;\red255\green128\blue0;\red0\green0\blue0;\red255\green255\blue0;` +
+			`\red74\green144\blue217;\red234\green242\blue251;\red60\green154\blue95;\red232\green245\blue236;` +
+			`\red217\green154\blue30;\red253\green244\blue225;\red208\green69\blue58;\red251\green233\blue231;}`,
+		`\paperw11906\paperh16838\margt1440\margr567\margb1134\margl1701`,
+		`{\footer\pard\plain\qc\f0\fs17 Page {\field{\*\fldinst PAGE}{\fldrslt 1}} of {\field{\*\fldinst NUMPAGES}{\fldrslt 1}}\par}`,
+		`{\fldrslt{\cf1\ul link}}`,
+	} {
+		if !strings.Contains(rtf, want) {
+			t.Errorf("RTF does not contain\n%s\n%s", want, rtf)
+		}
+	}
+	readRTF(t, rtf)
+}
+
+func TestInvalidRTFOptionsAreErrors(t *testing.T) {
+	opts := defaultRTFOptions()
+	for name, value := range map[string]string{
+		"paper":         "a0",
+		"margins":       "1,2",
+		"link-color":    "red",
+		"font-size":     "-3",
+		"heading-sizes": "20,10",
+	} {
+		if err := rtfOptionSetters[name](&opts, value); err == nil {
+			t.Errorf("%s = %s should be an error", name, value)
+		}
+	}
+}
+
+func genRTFString(t *testing.T, doc document) string {
+	t.Helper()
+	output, err := genRTF(doc)
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	return string(output)
+}
+
+// rtfDestinations are groups whose contents are not part of the text.
+var rtfDestinations = map[string]bool{
+	"fonttbl":    true,
+	"colortbl":   true,
+	"stylesheet": true,
+	"info":       true,
+	"pict":       true,
+	"fldinst":    true,
+	"header":     true,
+	"footer":     true,
+}
+
+// readRTF makes sure that all groups in the RTF code are balanced and returns
+// the plain text of the document and the contents of all field instructions.
+// It knows just enough RTF to read the output of genRTF: paragraphs end in a
+// new line, destinations are skipped and Unicode characters are decoded.
+func readRTF(t *testing.T, code string) (text string, fields []string) {
+	t.Helper()
+
+	type group struct {
+		skip    bool
+		field   bool
+		content []rune
+	}
+	stack := []group{{}}
+	top := func() *group { return &stack[len(stack)-1] }
+	var plain []rune
+	var surrogates []uint16
+	emit := func(r rune) {
+		g := top()
+		if g.field {
+			g.content = append(g.content, r)
+		} else if !g.skip {
+			plain = append(plain, r)
+		}
+	}
+
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		switch c {
+		case '{':
+			stack = append(stack, *top())
+			top().content = nil
+		case '}':
+			if len(stack) == 1 {
+				t.Fatalf("unbalanced '}' at offset %d", i)
+			}
+			g := top()
+			if g.field && !stack[len(stack)-2].field {
+				fields = append(fields, string(g.content))
+			}
+			stack = stack[:len(stack)-1]
+		case '\r', '\n':
+		case '\\':
+			i++
+			if i >= len(code) {
+				t.Fatal("RTF ends in a backslash")
+			}
+			c = code[i]
+			if !isASCIILetter(c) {
+				switch c {
+				case '*':
+					top().skip = true
+				case '\\', '{', '}':
+					emit(rune(c))
+				default:
+					t.Fatalf("unknown control symbol \\%c", c)
+				}
+				continue
+			}
+			start := i
+			for i < len(code) && isASCIILetter(code[i]) {
+				i++
+			}
+			word := code[start:i]
+			numStart := i
+			if i < len(code) && code[i] == '-' {
+				i++
+			}
+			for i < len(code) && '0' <= code[i] && code[i] <= '9' {
+				i++
+			}
+			num := code[numStart:i]
+			if i >= len(code) || code[i] != ' ' {
+				i-- // no delimiting space, the next character is content
+			}
+			if rtfDestinations[word] {
+				if word == "fldinst" {
+					top().field = true
+				} else {
+					top().skip = true
+				}
+			}
+			switch word {
+			case "par":
+				emit('\n')
+			case "line":
+				emit('\n')
+			case "tab":
+				emit('\t')
+			case "u":
+				var n int
+				for _, d := range strings.TrimPrefix(num, "-") {
+					n = n*10 + int(d-'0')
+				}
+				if strings.HasPrefix(num, "-") {
+					n = -n
+				}
+				surrogates = append(surrogates, uint16(int16(n)))
+				if !utf16.IsSurrogate(rune(surrogates[0])) || len(surrogates) == 2 {
+					for _, r := range utf16.Decode(surrogates) {
+						emit(r)
+					}
+					surrogates = surrogates[:0]
+				}
+				// skip the replacement character
+				i++
+			}
+		default:
+			emit(rune(c))
+		}
+	}
+	if len(stack) != 1 {
+		t.Fatalf("%d unclosed groups", len(stack)-1)
+	}
+	return strings.TrimRight(string(plain), "\n"), fields
+}
+
+func isASCIILetter(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
@@ -2,4 +2,7 @@ module github.com/gonutz/helpgen
 
 go 1.11
 
-require github.com/gonutz/bmp v1.0.0
+require (
+	github.com/gonutz/bmp v1.0.0
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
+)
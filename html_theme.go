@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// htmlThemes are the built-in style sheets that can be selected with the
+// -theme option. The custom style sheet given with -css is appended after the
+// theme so it can override any of its rules.
+var htmlThemes = map[string]string{
+	"light": lightTheme,
+	"dark":  darkTheme,
+	"print": printTheme,
+	"auto":  lightTheme + "@media (prefers-color-scheme: dark) {\n" + darkTheme + "}\n",
+	"none":  "",
+}
+
+const defaultHTMLTheme = "light"
+
+const lightTheme = ` body{
+  background-color: #D7EEEF;
+  text-align: left;
+  max-width:800px;
+  margin-left: auto;
+  margin-right: auto;
+ }
+ code, kbd{
+  font-family: Consolas, monospace;
+ }
+ kbd{
+  border: 1px solid #808080;
+  border-radius: 3px;
+  padding: 0 3px;
+  background-color: #F4F4F4;
+ }
+ aside.admonition{
+  margin: 1em 0;
+  padding: 0 1em;
+  border-left: 4px solid #4A90D9;
+  background-color: #EAF2FB;
+ }
+ aside.tip{
+  border-color: #3C9A5F;
+  background-color: #E8F5EC;
+ }
+ aside.warning{
+  border-color: #D99A1E;
+  background-color: #FDF4E1;
+ }
+ aside.danger{
+  border-color: #D0453A;
+  background-color: #FBE9E7;
+ }
+ .admonition-title{
+  font-weight: bold;
+ }
+ .admonition-icon{
+  vertical-align: -0.125em;
+  margin-right: 0.4em;
+ }
+ .footnotes{
+  font-size: 0.9em;
+ }
+ .footnote-back{
+  text-decoration: none;
+ }
+`
+
+const darkTheme = ` body{
+  background-color: #1E2224;
+  color: #DCDCDC;
+  text-align: left;
+  max-width:800px;
+  margin-left: auto;
+  margin-right: auto;
+ }
+ a{
+  color: #8AB4F8;
+ }
+ a:visited{
+  color: #C58AF9;
+ }
+ code, kbd{
+  font-family: Consolas, monospace;
+ }
+ kbd{
+  border: 1px solid #5F6368;
+  border-radius: 3px;
+  padding: 0 3px;
+  background-color: #2D3134;
+ }
+ aside.admonition{
+  margin: 1em 0;
+  padding: 0 1em;
+  border-left: 4px solid #8AB4F8;
+  background-color: #242C38;
+ }
+ aside.tip{
+  border-color: #81C995;
+  background-color: #223027;
+ }
+ aside.warning{
+  border-color: #FDD663;
+  background-color: #332E1E;
+ }
+ aside.danger{
+  border-color: #F28B82;
+  background-color: #3A2422;
+ }
+ .admonition-title{
+  font-weight: bold;
+ }
+ .admonition-icon{
+  vertical-align: -0.125em;
+  margin-right: 0.4em;
+ }
+ .footnotes{
+  font-size: 0.9em;
+ }
+ .footnote-back{
+  text-decoration: none;
+ }
+`
+
+const printTheme = ` body{
+  background-color: white;
+  color: black;
+  font-family: Georgia, "Times New Roman", serif;
+  text-align: left;
+  margin: 0;
+ }
+ a{
+  color: black;
+ }
+ img{
+  max-width: 100%;
+ }
+ h1, h2, h3, h4{
+  page-break-after: avoid;
+ }
+ code, kbd{
+  font-family: "Courier New", monospace;
+ }
+ kbd{
+  border: 1px solid black;
+  padding: 0 2px;
+ }
+ aside.admonition{
+  margin: 1em 0;
+  padding: 0 1em;
+  border: 1px solid black;
+  page-break-inside: avoid;
+ }
+ aside.danger{
+  border-width: 3px;
+ }
+ .admonition-title{
+  font-weight: bold;
+ }
+ .admonition-icon{
+  vertical-align: -0.125em;
+  margin-right: 0.4em;
+ }
+ .footnotes{
+  font-size: 0.9em;
+ }
+ .footnote-back{
+  text-decoration: none;
+ }
+`
+
+func htmlThemeNames() string {
+	var names []string
+	for name := range htmlThemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func findHTMLTheme(name string) (string, error) {
+	css, ok := htmlThemes[strings.ToLower(name)]
+	if !ok {
+		return "", fmt.Errorf("unknown HTML theme '%s', available themes are: %s", name, htmlThemeNames())
+	}
+	return css, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// lintWarning is a problem in a help file. line is 0 for warnings about the
+// whole file.
+type lintWarning struct {
+	line int
+	msg  string
+	// fatal is true if the problem keeps the file from being generated
+	fatal bool
+}
+
+// lintHelp parses the code and reports suspicious markup. It also returns the
+// names of all images used in the code, in lower case, see unusedImages.
+// Errors that keep the code from being parsed are returned as err, except for
+// unknown and ambiguous link targets which are reported as warnings.
+func lintHelp(code []byte) (warnings []lintWarning, images []string, err error) {
+	p := parser{code: code}
+	p.warn = func(line int, msg string) {
+		warnings = append(warnings, lintWarning{line: line, msg: msg})
+	}
+	p.parse()
+	if p.err != nil {
+		return nil, nil, p.err
+	}
+
+	// variables are used by writing their name in brackets anywhere outside
+	// of variable definitions
+	var text []string
+	for _, line := range strings.Split(string(p.code), "\n") {
+		if !strings.HasPrefix(line, `[\`) {
+			text = append(text, line)
+		}
+	}
+	used := strings.Join(text, "\n")
+	for name, v := range p.vars {
+		if !strings.Contains(used, "["+name+"]") {
+			warnings = append(warnings, lintWarning{
+				line: v.declLineNumber,
+				msg:  fmt.Sprintf("variable '%s' is never used", name),
+			})
+		}
+	}
+
+	captionLine := make(map[string]int)
+	var captions []string
+	for i, part := range p.doc.parts {
+		if h, _, ok := headingOf(part); ok {
+			if first, ok := captionLine[h.text]; ok {
+				warnings = append(warnings, lintWarning{
+					line: p.doc.position(i).start.line,
+					msg:  fmt.Sprintf("caption '%s' has the same text as the caption in line %d", h.text, first),
+				})
+			} else {
+				captionLine[h.text] = p.doc.position(i).start.line
+				captions = append(captions, h.text)
+			}
+		}
+	}
+
+	paths := captionPaths(p.doc)
+	p.doc.walk(func(part docPart, _ sourceRange) {
+		switch part := part.(type) {
+		case tempRef:
+			matches := matchCaptions(paths, part.target)
+			if len(matches) > 1 {
+				warnings = append(warnings, lintWarning{
+					line:  part.declLine,
+					msg:   ambiguousRefError(part, matches).Error(),
+					fatal: true,
+				})
+			}
+			if len(matches) > 0 {
+				return
+			}
+			if _, ok := externalLink(part); ok {
+				return
+			}
+			msg := fmt.Sprintf("unknown link target '%s'", part.target)
+			if guess := closestCaption(part.target, captions); guess != "" {
+				msg += fmt.Sprintf(", did you mean '%s'?", guess)
+			}
+			warnings = append(warnings, lintWarning{line: part.declLine, msg: msg, fatal: true})
+		case docImage:
+			images = append(images, strings.ToLower(part.name))
+		}
+	})
+
+	// explicit caption ids may not be used twice
+	p.assignIDs()
+	if p.err != nil {
+		return nil, nil, p.err
+	}
+
+	sort.SliceStable(warnings, func(i, j int) bool {
+		return warnings[i].line < warnings[j].line
+	})
+	return warnings, images, nil
+}
+
+// closestCaption returns the caption that is most similar to the link target,
+// if there is one that differs only by a few typos.
+func closestCaption(target string, captions []string) string {
+	best, bestDist := "", -1
+	for _, caption := range captions {
+		d := editDistance(strings.ToLower(target), strings.ToLower(caption))
+		if bestDist == -1 || d < bestDist {
+			best, bestDist = caption, d
+		}
+	}
+	maxDist := len([]rune(target)) / 3
+	if maxDist < 1 {
+		maxDist = 1
+	}
+	if bestDist == -1 || bestDist > maxDist {
+		return ""
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b, the number of
+// characters that need to be inserted, deleted or changed to turn a into b.
+func editDistance(a, b string) int {
+	x, y := []rune(a), []rune(b)
+	row := make([]int, len(y)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		diag := row[0]
+		row[0] = i
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+			next := min3(row[j]+1, row[j-1]+1, diag+cost)
+			diag = row[j]
+			row[j] = next
+		}
+	}
+	return row[len(y)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// unusedImages returns the paths of all image files under dir that are not in
+// used, which holds lower case file names. Images are found by name in all
+// sub folders, see findImage. Hidden folders like .git, other version control
+// folders and the images that the LaTeX generator writes are skipped.
+func unusedImages(dir string, used map[string]bool) []string {
+	var unused []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path != dir && skipImageDir(info.Name()) {
+			return filepath.SkipDir
+		}
+		if err == nil && !info.IsDir() && hasImageExt(info.Name()) && !used[strings.ToLower(info.Name())] {
+			unused = append(unused, path)
+		}
+		return nil
+	})
+	return unused
+}
+
+// skipImageDir returns true for hidden folders, version control folders and
+// latexImageFolder, which do not contain the images of help files.
+func skipImageDir(name string) bool {
+	return strings.HasPrefix(name, ".") || name == "CVS" || name == "_darcs" ||
+		name == latexImageFolder
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLintWarnings(t *testing.T) {
+	warnings, images, err := lintHelp([]byte(`[\used=text]
+[\unused=text]
+Options
+=======
+See [Optoins], [used], [www.example.com] and *bold.
+Some text
+that was meant as a paragraph
+-----------------------------
+Options
+=======
+a [Picture.PNG] and/or *unclosed
+run ` + "`go vet" + `
+!!! hint
+text`))
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	want := []lintWarning{
+		{2, "variable 'unused' is never used", false},
+		{5, "'*' is not closed, write [*] if it is meant literally", false},
+		{5, "unknown link target 'Optoins', did you mean 'Options'?", true},
+		{8, "the underline makes line 7 the caption 'that was meant as a paragraph', add an empty line before it if this is intended", false},
+		{9, "caption 'Options' has the same text as the caption in line 3", false},
+		{11, "'*' is not closed, write [*] if it is meant literally", false},
+		{12, "'`' is not closed, write [`] if it is meant literally", false},
+		{13, "'hint' is not an admonition and stays as text, use one of: note, tip, warning, danger", false},
+	}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("want\n%v\nbut have\n%v", want, warnings)
+	}
+	if !reflect.DeepEqual(images, []string{"picture.png"}) {
+		t.Errorf("wrong images %v", images)
+	}
+}
+
+func TestLintWithoutWarnings(t *testing.T) {
+	warnings, _, err := lintHelp([]byte(`Caption
+=======
+Text with *bold*, 5 * 3 and a [link[Caption]].
+/usr/bin and ~/.config are paths.
+
+Sub
+---`))
+	if err != nil {
+		t.Fatal("got error:", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"kitten", "sitting", 3},
+		{"Optoins", "Options", 2},
+		{"äb", "ab", 1},
+	} {
+		if got := editDistance(test.a, test.b); got != test.want {
+			t.Errorf("%q %q: want %d but have %d", test.a, test.b, test.want, got)
+		}
+	}
+}
+
+func TestUnusedImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helpgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "sub"), 0777)
+	os.Mkdir(filepath.Join(dir, ".git"), 0777)
+	os.Mkdir(filepath.Join(dir, latexImageFolder), 0777)
+	for _, name := range []string{
+		"used.png", "sub/unused.jpg", "notes.txt", ".git/logo.png", latexImageFolder + "/image1.png",
+	} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0666)
+	}
+	unused := unusedImages(dir, map[string]bool{"used.png": true})
+	want := []string{filepath.Join(dir, "sub", "unused.jpg")}
+	if !reflect.DeepEqual(unused, want) {
+		t.Errorf("want %v but have %v", want, unused)
+	}
+}
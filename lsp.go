@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// runLSP is a Language Server Protocol server for help files. It reads
+// requests from in and writes responses to out until the client sends the exit
+// notification. Documents are always synchronized in full.
+func runLSP(in io.Reader, out io.Writer) error {
+	s := lspServer{
+		in:   bufio.NewReader(in),
+		out:  out,
+		docs: make(map[string]string),
+	}
+	for {
+		msg, err := s.read()
+		if err != nil {
+			return err
+		}
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return errors.New("exit without shutdown")
+			}
+			return nil
+		}
+		result, err := s.handle(msg)
+		if msg.ID == nil {
+			// notifications have no response
+			continue
+		}
+		if err != nil {
+			s.write(lspMessage{ID: msg.ID, Error: &lspError{Code: -32603, Message: err.Error()}})
+		} else {
+			s.write(lspMessage{ID: msg.ID, Result: result})
+		}
+	}
+}
+
+type lspServer struct {
+	in  *bufio.Reader
+	out io.Writer
+	// docs are the texts of all open documents by URI
+	docs     map[string]string
+	shutdown bool
+}
+
+// lspMessage is a JSON-RPC request, response or notification.
+type lspMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string              `json:"name"`
+	Kind           int                 `json:"kind"`
+	Range          lspRange            `json:"range"`
+	SelectionRange lspRange            `json:"selectionRange"`
+	Children       []lspDocumentSymbol `json:"children"`
+}
+
+// These are constants of the protocol.
+const (
+	lspSeverityError      = 1
+	lspSeverityWarning    = 2
+	lspCompletionVariable = 6
+	lspCompletionRef      = 18
+	lspSymbolString       = 15
+)
+
+func (s *lspServer) read() (lspMessage, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return lspMessage{}, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(strings.ToLower(line), "content-length:") {
+			length, err = strconv.Atoi(strings.TrimSpace(line[len("content-length:"):]))
+			if err != nil {
+				return lspMessage{}, errors.New("invalid Content-Length: " + line)
+			}
+		}
+	}
+	if length < 0 {
+		return lspMessage{}, errors.New("missing Content-Length header")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.in, body); err != nil {
+		return lspMessage{}, err
+	}
+	var msg lspMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return lspMessage{}, errors.New("invalid message: " + err.Error())
+	}
+	return msg, nil
+}
+
+func (s *lspServer) write(msg lspMessage) {
+	msg.JSONRPC = "2.0"
+	if msg.ID != nil && msg.Result == nil && msg.Error == nil {
+		// responses without a result must have a null result
+		msg.Result = json.RawMessage("null")
+	}
+	body, _ := json.Marshal(msg)
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *lspServer) notify(method string, params interface{}) {
+	data, _ := json.Marshal(params)
+	s.write(lspMessage{Method: method, Params: data})
+}
+
+func (s *lspServer) handle(msg lspMessage) (interface{}, error) {
+	switch msg.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync": 1, // full
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{"["},
+				},
+				"hoverProvider":          true,
+				"definitionProvider":     true,
+				"documentSymbolProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "helpgen"},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		s.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			s.update(params.TextDocument.URI, params.ContentChanges[n-1].Text)
+		}
+	case "textDocument/didClose":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		delete(s.docs, params.TextDocument.URI)
+	case "textDocument/definition":
+		return s.positionRequest(msg, s.definition)
+	case "textDocument/hover":
+		return s.positionRequest(msg, s.hover)
+	case "textDocument/completion":
+		return s.positionRequest(msg, s.completion)
+	case "textDocument/documentSymbol":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return documentSymbols(s.docs[params.TextDocument.URI]), nil
+	default:
+		if msg.ID != nil {
+			return nil, errors.New("method not supported: " + msg.Method)
+		}
+	}
+	return nil, nil
+}
+
+// positionRequest calls the handler with the document's text, the text of the
+// line at the requested position and the byte offset in that line.
+func (s *lspServer) positionRequest(
+	msg lspMessage,
+	handler func(uri, text, line string, char int) interface{},
+) (interface{}, error) {
+	var params lspTextDocumentPosition
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return nil, err
+	}
+	text := s.docs[params.TextDocument.URI]
+	lines := strings.Split(text, "\n")
+	line := params.Position.Line
+	if line < 0 || line >= len(lines) {
+		return nil, nil
+	}
+	char := byteOffset(lines[line], params.Position.Character)
+	return handler(params.TextDocument.URI, text, lines[line], char), nil
+}
+
+// update stores the new text of a document and publishes its diagnostics. The
+// line breaks are unified once, so all requests count lines like the parser.
+func (s *lspServer) update(uri, text string) {
+	text = string(unifyLineBreaks([]byte(text)))
+	s.docs[uri] = text
+	lines := strings.Split(text, "\n")
+	diagnostic := func(line int, msg string, severity int) lspDiagnostic {
+		// lines are 1-indexed, 0 means the whole file
+		if line > 0 {
+			line--
+		}
+		end := 0
+		if line < len(lines) {
+			end = utf16Length(lines[line])
+		}
+		return lspDiagnostic{
+			Range: lspRange{
+				Start: lspPosition{Line: line},
+				End:   lspPosition{Line: line, Character: end},
+			},
+			Severity: severity,
+			Source:   "helpgen",
+			Message:  msg,
+		}
+	}
+
+	diagnostics := []lspDiagnostic{}
+	warnings, _, err := lintHelp([]byte(text))
+	if err != nil {
+		diagnostics = append(diagnostics, diagnostic(errorLine(err), err.Error(), lspSeverityError))
+	}
+	for _, w := range warnings {
+		severity := lspSeverityWarning
+		if w.fatal {
+			severity = lspSeverityError
+		}
+		diagnostics = append(diagnostics, diagnostic(w.line, w.msg, severity))
+	}
+	s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+		"uri":         uri,
+		"diagnostics": diagnostics,
+	})
+}
+
+// errorLine returns the line of a parse error, or 0 if it is about the whole
+// file.
+func errorLine(err error) int {
+	if e, ok := err.(lineError); ok {
+		return e.line
+	}
+	return 0
+}
+
+// helpOutline is what the language server needs to know about a help file.
+type helpOutline struct {
+	vars     varTable
+	captions []captionPath
+	// lines is the number of lines in the file
+	lines int
+}
+
+// outlineHelp parses the code as far as possible, it does not resolve links,
+// so unknown link targets in the code do not matter.
+func outlineHelp(code string) helpOutline {
+	p := parser{code: []byte(code)}
+	p.parse()
+	outline := helpOutline{
+		vars:  p.vars,
+		lines: strings.Count(string(p.code), "\n") + 1,
+	}
+	if p.err == nil {
+		outline.captions = captionPaths(p.doc)
+	}
+	return outline
+}
+
+// refAt returns the target of the reference in brackets at the byte offset
+// char. For references with an alternative text the target is the inner part,
+// e.g. "Caption" for "[text[Caption]]".
+func refAt(line string, char int) (target string, ok bool) {
+	if char >= len(line) {
+		return "", false
+	}
+	start := strings.LastIndex(line[:char+1], "[")
+	if start == -1 {
+		return "", false
+	}
+	end := strings.Index(line[start:], "]")
+	if end == -1 {
+		return "", false
+	}
+	end += start
+	if end < char && !(end+1 == char && line[char] == ']') {
+		// the cursor is behind the reference
+		return "", false
+	}
+	target = line[start+1 : end]
+	target = target[strings.LastIndex(target, "[")+1:]
+	return target, target != ""
+}
+
+func (s *lspServer) definition(uri, text, line string, char int) interface{} {
+	target, ok := refAt(line, char)
+	if !ok {
+		return nil
+	}
+	outline := outlineHelp(text)
+	if v, ok := outline.vars[target]; ok {
+		return lspLocation{URI: uri, Range: lineRange(v.declLineNumber)}
+	}
+	var locations []lspLocation
+	for _, c := range matchCaptions(outline.captions, target) {
+		locations = append(locations, lspLocation{URI: uri, Range: lineRange(c.line)})
+	}
+	if len(locations) == 0 {
+		return nil
+	}
+	return locations
+}
+
+func (s *lspServer) hover(uri, text, line string, char int) interface{} {
+	target, ok := refAt(line, char)
+	if !ok {
+		return nil
+	}
+	outline := outlineHelp(text)
+	var value string
+	if v, ok := outline.vars[target]; ok {
+		value = fmt.Sprintf("variable `%s` = `%s`", target, v.text)
+	} else if matches := matchCaptions(outline.captions, target); len(matches) > 0 {
+		var paths []string
+		for _, c := range matches {
+			paths = append(paths, fmt.Sprintf("%s (line %d)", strings.Join(c.path, " > "), c.line))
+		}
+		value = "caption " + strings.Join(paths, ", ")
+	} else {
+		return nil
+	}
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": value},
+	}
+}
+
+func (s *lspServer) completion(uri, text, line string, char int) interface{} {
+	// only complete inside an open bracket
+	before := line[:char]
+	start := strings.LastIndex(before, "[")
+	if start == -1 || strings.Contains(before[start:], "]") {
+		return []lspCompletionItem{}
+	}
+	outline := outlineHelp(text)
+	items := []lspCompletionItem{}
+	seen := make(map[string]bool)
+	for _, c := range outline.captions {
+		label := c.path[len(c.path)-1]
+		if seen[label] {
+			continue
+		}
+		seen[label] = true
+		items = append(items, lspCompletionItem{
+			Label:  label,
+			Kind:   lspCompletionRef,
+			Detail: strings.Join(c.path, " > "),
+		})
+	}
+	var names []string
+	for name := range outline.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		items = append(items, lspCompletionItem{
+			Label:  name,
+			Kind:   lspCompletionVariable,
+			Detail: outline.vars[name].text,
+		})
+	}
+	return items
+}
+
+// documentSymbols returns the captions of the document as a tree. Every
+// caption's range goes up to the line before the next caption of the same or a
+// higher level. text has unified line breaks.
+func documentSymbols(text string) []lspDocumentSymbol {
+	outline := outlineHelp(text)
+	type node struct {
+		symbol   lspDocumentSymbol
+		depth    int
+		children []*node
+	}
+	var roots []*node
+	var stack []*node
+	var all []*node
+	for _, c := range outline.captions {
+		n := &node{
+			symbol: lspDocumentSymbol{
+				Name:           c.path[len(c.path)-1],
+				Kind:           lspSymbolString,
+				Range:          lineRange(c.line),
+				SelectionRange: lineRange(c.line),
+				Children:       []lspDocumentSymbol{},
+			},
+			depth: len(c.path),
+		}
+		for len(stack) > 0 && stack[len(stack)-1].depth >= n.depth {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			roots = append(roots, n)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, n)
+		}
+		stack = append(stack, n)
+		all = append(all, n)
+	}
+	// a caption ends at the end of the line before the next caption that is
+	// not below it
+	lines := strings.Split(text, "\n")
+	for i, n := range all {
+		// end is the 1-indexed last line
+		end := outline.lines
+		for _, next := range all[i+1:] {
+			if next.depth <= n.depth {
+				end = next.symbol.Range.Start.Line
+				break
+			}
+		}
+		n.symbol.Range.End = lspPosition{Line: end - 1}
+		if end-1 < len(lines) {
+			n.symbol.Range.End.Character = utf16Length(lines[end-1])
+		}
+	}
+	var build func(nodes []*node) []lspDocumentSymbol
+	build = func(nodes []*node) []lspDocumentSymbol {
+		symbols := []lspDocumentSymbol{}
+		for _, n := range nodes {
+			n.symbol.Children = build(n.children)
+			symbols = append(symbols, n.symbol)
+		}
+		return symbols
+	}
+	return build(roots)
+}
+
+// lineRange is the start of a 1-indexed line.
+func lineRange(line int) lspRange {
+	pos := lspPosition{Line: line - 1}
+	if pos.Line < 0 {
+		pos.Line = 0
+	}
+	return lspRange{Start: pos, End: pos}
+}
+
+// byteOffset converts an offset in UTF-16 code units, which LSP uses, to a
+// byte offset in the line.
+func byteOffset(line string, utf16Offset int) int {
+	units := 0
+	for i, r := range line {
+		if units >= utf16Offset {
+			return i
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return len(line)
+}
+
+func utf16Length(s string) int {
+	n := 0
+	for _, r := range s {
+		n += len(utf16.Encode([]rune{r}))
+	}
+	return n
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const lspTestDoc = `[\version=1.2.3]
+=====
+Tool
+=====
+Export
+======
+Version [version], see [Options[Export > Options]] and [Imprt].
+
+Options
+-------
+Import
+======
+`
+
+func TestLSPSession(t *testing.T) {
+	var in bytes.Buffer
+	id := 0
+	send := func(method string, params interface{}) {
+		msg := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+		if !strings.HasPrefix(method, "textDocument/did") && method != "exit" {
+			id++
+			msg["id"] = id
+		}
+		data, _ := json.Marshal(msg)
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	}
+	at := func(line, char int) map[string]interface{} {
+		return map[string]interface{}{
+			"textDocument": map[string]string{"uri": "file:///a.help"},
+			"position":     map[string]int{"line": line, "character": char},
+		}
+	}
+	send("initialize", map[string]interface{}{})
+	send("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]string{"uri": "file:///a.help", "text": lspTestDoc},
+	})
+	send("textDocument/definition", at(6, 33))
+	send("textDocument/definition", at(6, 10))
+	send("textDocument/hover", at(6, 10))
+	send("textDocument/completion", at(6, 57))
+	send("textDocument/documentSymbol", at(0, 0))
+	send("shutdown", nil)
+	send("exit", nil)
+
+	var out bytes.Buffer
+	if err := runLSP(&in, &out); err != nil {
+		t.Fatal(err)
+	}
+	msgs := readLSPMessages(t, &out)
+	if len(msgs) != 8 {
+		t.Fatalf("want 8 messages but have %d: %v", len(msgs), msgs)
+	}
+
+	checkJSON := func(name string, got interface{}, want string) {
+		t.Helper()
+		var w interface{}
+		if err := json.Unmarshal([]byte(want), &w); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, w) {
+			data, _ := json.Marshal(got)
+			t.Errorf("%s: want\n%s\nbut have\n%s", name, want, data)
+		}
+	}
+	caps := msgs[0]["result"].(map[string]interface{})["capabilities"].(map[string]interface{})
+	if caps["definitionProvider"] != true || caps["hoverProvider"] != true {
+		t.Errorf("missing capabilities %v", caps)
+	}
+	checkJSON("diagnostics", msgs[1]["params"], `{
+		"uri": "file:///a.help",
+		"diagnostics": [{
+			"range": {"start": {"line": 6, "character": 0}, "end": {"line": 6, "character": 63}},
+			"severity": 1,
+			"source": "helpgen",
+			"message": "unknown link target 'Imprt', did you mean 'Import'?"
+		}]
+	}`)
+	checkJSON("caption definition", msgs[2]["result"], `[{
+		"uri": "file:///a.help",
+		"range": {"start": {"line": 8, "character": 0}, "end": {"line": 8, "character": 0}}
+	}]`)
+	checkJSON("variable definition", msgs[3]["result"], `{
+		"uri": "file:///a.help",
+		"range": {"start": {"line": 0, "character": 0}, "end": {"line": 0, "character": 0}}
+	}`)
+	checkJSON("hover", msgs[4]["result"], `{"contents": {"kind": "markdown", "value": "variable `+"`version` = `1.2.3`"+`"}}`)
+	checkJSON("completion", msgs[5]["result"], `[
+		{"label": "Tool", "kind": 18, "detail": "Tool"},
+		{"label": "Export", "kind": 18, "detail": "Tool > Export"},
+		{"label": "Options", "kind": 18, "detail": "Tool > Export > Options"},
+		{"label": "Import", "kind": 18, "detail": "Tool > Import"},
+		{"label": "version", "kind": 6, "detail": "1.2.3"}
+	]`)
+	checkJSON("symbols", msgs[6]["result"], `[{
+		"name": "Tool", "kind": 15,
+		"range": {"start": {"line": 2, "character": 0}, "end": {"line": 12, "character": 0}},
+		"selectionRange": {"start": {"line": 2, "character": 0}, "end": {"line": 2, "character": 0}},
+		"children": [{
+			"name": "Export", "kind": 15,
+			"range": {"start": {"line": 4, "character": 0}, "end": {"line": 9, "character": 7}},
+			"selectionRange": {"start": {"line": 4, "character": 0}, "end": {"line": 4, "character": 0}},
+			"children": [{
+				"name": "Options", "kind": 15,
+				"range": {"start": {"line": 8, "character": 0}, "end": {"line": 9, "character": 7}},
+				"selectionRange": {"start": {"line": 8, "character": 0}, "end": {"line": 8, "character": 0}},
+				"children": []
+			}]
+		}, {
+			"name": "Import", "kind": 15,
+			"range": {"start": {"line": 10, "character": 0}, "end": {"line": 12, "character": 0}},
+			"selectionRange": {"start": {"line": 10, "character": 0}, "end": {"line": 10, "character": 0}},
+			"children": []
+		}]
+	}]`)
+}
+
+func TestLSPCountsLinesLikeTheParser(t *testing.T) {
+	text, _ := json.Marshal(strings.Replace(lspTestDoc, "\n", "\r", -1))
+	var in bytes.Buffer
+	for i, msg := range []string{
+		`{"jsonrpc": "2.0", "method": "textDocument/didOpen", "params": {"textDocument": {"uri": "file:///a.help", "text": ` +
+			string(text) + `}}}`,
+		`{"jsonrpc": "2.0", "id": 1, "method": "textDocument/definition", "params": {"textDocument": {"uri": "file:///a.help"}, "position": {"line": 6, "character": 33}}}`,
+		`{"jsonrpc": "2.0", "id": 2, "method": "shutdown"}`,
+		`{"jsonrpc": "2.0", "method": "exit"}`,
+	} {
+		if !json.Valid([]byte(msg)) {
+			t.Fatalf("message %d is not valid JSON", i)
+		}
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(msg), msg)
+	}
+	var out bytes.Buffer
+	if err := runLSP(&in, &out); err != nil {
+		t.Fatal(err)
+	}
+	msgs := readLSPMessages(t, &out)
+	if len(msgs) != 3 {
+		t.Fatalf("want 3 messages but have %d: %v", len(msgs), msgs)
+	}
+	diags := msgs[0]["params"].(map[string]interface{})["diagnostics"].([]interface{})
+	if len(diags) != 1 {
+		t.Fatalf("want 1 diagnostic but have %v", diags)
+	}
+	start := diags[0].(map[string]interface{})["range"].(map[string]interface{})["start"]
+	if line := start.(map[string]interface{})["line"]; line != 6.0 {
+		t.Errorf("want diagnostic in line 6 but have %v", line)
+	}
+	defs, ok := msgs[1]["result"].([]interface{})
+	if !ok || len(defs) != 1 {
+		t.Fatalf("want 1 definition but have %v", msgs[1]["result"])
+	}
+	start = defs[0].(map[string]interface{})["range"].(map[string]interface{})["start"]
+	if line := start.(map[string]interface{})["line"]; line != 8.0 {
+		t.Errorf("want definition in line 8 but have %v", line)
+	}
+}
+
+func TestLSPErrorLineComesFromTheParser(t *testing.T) {
+	_, err := parse([]byte("===\rA\r===\r\r===\rB\r==="))
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	if line := errorLine(err); line != 6 {
+		t.Errorf("want error in line 6 but have %d (%v)", line, err)
+	}
+}
+
+func TestLSPRefAt(t *testing.T) {
+	line := "a [b] [text[c d]] e"
+	for char, want := range map[int]string{
+		0: "", 2: "b", 3: "b", 4: "b", 5: "",
+		6: "c d", 8: "c d", 12: "c d", 16: "c d", 18: "",
+	} {
+		if got, _ := refAt(line, char); got != want {
+			t.Errorf("%d: want '%s' but have '%s'", char, want, got)
+		}
+	}
+}
+
+func readLSPMessages(t *testing.T, r io.Reader) []map[string]interface{} {
+	t.Helper()
+	s := lspServer{in: bufio.NewReader(r)}
+	var msgs []map[string]interface{}
+	for {
+		msg, err := s.read()
+		if err == io.EOF {
+			return msgs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := json.Marshal(msg)
+		var m map[string]interface{}
+		json.Unmarshal(data, &m)
+		msgs = append(msgs, m)
+	}
+}
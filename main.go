@@ -1,30 +1,216 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 )
 
 func usage() {
-	fmt.Println(`usage: helpgen [-html/-rtf] < input.help > output.html
+	fmt.Println(`usage: helpgen [-html/-rtf/-pdf/-epub/-man/-docx/-odt/-latex/-json] [options] < input.help > output.html
   If no output format is specified, HTML is used.
   Stdin is used to read the input script.
-  Stdout is used to write the generated output.`)
-}
+  Stdout is used to write the generated output.
+
+usage: helpgen fmt [-check] [files]
+  Formats help files: trims trailing white space, collapses empty lines, makes
+  caption underlines as long as their captions and removes unnecessary escapes.
+  The given files are changed in place. Without files, stdin is formatted and
+  written to stdout.
+  -check  only list the files that are not formatted and exit with code 1 if
+          there are any, nothing is changed
+
+usage: helpgen lint [files]
+  Warns about markup that is valid but probably a mistake: unused variables,
+  unknown link targets, styles that are not closed, captions directly below
+  text, captions with the same text and images that no help file uses. Without
+  files, stdin is checked. The exit code is 1 if there are any warnings.
+
+usage: helpgen lsp
+  Runs a Language Server Protocol server for help files on stdin and stdout,
+  for use in editors. It shows errors and lint warnings, completes caption and
+  variable names in brackets, goes to the definition of links and variables,
+  shows variable values on hover and lists the captions as symbols.
+
+Input options:
+  -from format    the input format, one of: help, json, md
+                  the default is help, json reads the output of -json and md
+                  reads Markdown
+
+HTML and EPUB options:
+  -theme name     use a built-in style, one of: ` + htmlThemeNames() + `
+                  the default is ` + defaultHTMLTheme + `
+  -css file       inline the given style sheet after the theme's styles
+  -lang code      the document language, the default is ` + defaultHTMLLang + `
+  -template file  use the given html/template file as the page layout, it can
+                  use the fields {{.Title}}, {{.Lang}}, {{.CSS}}, {{.TOC}}
+                  and {{.Body}}
 
-var generators = map[string]func(document) ([]byte, error){
-	"-html": genHTML,
-	"-rtf":  genRTF,
+EPUB options:
+  -epub-date date the modification date, e.g. 2024-05-01 or
+                  2024-05-01T12:00:00Z, the default is now, a fixed date
+                  makes the output reproducible
+
+RTF options:
+  -font name           the font for text, the default is Calibri
+  -heading-font name   the font for the title and captions
+  -font-size pt        the text size in points, the default is 11
+  -heading-sizes list  the sizes in points of the title and the three caption
+                       levels, separated by commas, e.g. 22.5,20,17,11
+  -mono-font name      the font for code, the default is Consolas
+  -link-color #RRGGBB  the color of links
+  -heading-color #RRGGBB
+                       the color of the title and captions
+  -paper size          one of ` + paperSizeNames() + ` or WIDTHxHEIGHT in
+                       millimeters, e.g. 210x297
+  -margins mm          the page margins in millimeters, either one value for
+                       all or four values for top,right,bottom,left
+  -header text         text at the top of each page, {page} and {pages} are
+                       replaced by the page number and the number of pages
+  -footer text         text at the bottom of each page, like -header
+  -rtf-config file     read RTF options from a file with lines of the form
+                       name = value, where name is one of the options above
+                       without the leading -
+
+man page options:
+  -man-section n       the manual section, the default is 1
+  -man-date date       the date of the last change, the default is today
+
+LaTeX options:
+  -latex-images dir    the folder of the .tex file, images are written to its
+                       sub-folder ` + latexImageFolder + `, the default is the
+                       current working directory`)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		formatCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		lintCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "lsp" {
+		if err := runLSP(os.Stdin, os.Stdout); err != nil {
+			fail(1, "language server: %s\n", err.Error())
+		}
+		return
+	}
+
 	var (
 		code      []byte
-		generator = genHTML
+		inputPath string
+		htmlOpts  = htmlOptions{theme: defaultHTMLTheme, lang: defaultHTMLLang}
+		rtfOpts   = defaultRTFOptions()
+		manOpts   = manOptions{section: "1"}
+		latexOpts = latexOptions{imageDir: "."}
+		// epubModified is the EPUB modification date, now if it is zero
+		epubModified time.Time
 	)
 
+	generators := map[string]func(document) ([]byte, error){
+		"-html": func(doc document) ([]byte, error) {
+			return genHTMLWithOptions(doc, htmlOpts)
+		},
+		"-rtf": func(doc document) ([]byte, error) {
+			return genRTFWithOptions(doc, rtfOpts)
+		},
+		"-pdf": genPDF,
+		"-epub": func(doc document) ([]byte, error) {
+			return genEPUBWithOptions(doc, epubOptions{htmlOptions: htmlOpts, modified: epubModified})
+		},
+		"-man": func(doc document) ([]byte, error) {
+			return genManWithOptions(doc, manOpts)
+		},
+		"-docx": genDOCX,
+		"-odt":  genODT,
+		"-latex": func(doc document) ([]byte, error) {
+			return genLaTeXWithOptions(doc, latexOpts)
+		},
+		"-json": genJSON,
+	}
+	generator := generators["-html"]
+
+	// parsers get the input file name for the source positions, JSON
+	// documents store their own file name
+	parsers := map[string]func(file string, code []byte) (document, error){
+		"help": parseFile,
+		"json": func(_ string, code []byte) (document, error) {
+			return parseJSON(code)
+		},
+		"md": parseMarkdownFile,
+	}
+	parseInput := parsers["help"]
+
+	// options that take a value, the value is the argument after the option
+	valueOptions := map[string]func(value string){
+		"-from": func(format string) {
+			p, ok := parsers[format]
+			if !ok {
+				fail(1, "unknown input format '%s'\n", format)
+			}
+			parseInput = p
+		},
+		"-theme": func(name string) {
+			htmlOpts.theme = name
+		},
+		"-lang": func(code string) {
+			htmlOpts.lang = code
+		},
+		"-css": func(path string) {
+			css, err := ioutil.ReadFile(path)
+			if err != nil {
+				fail(1, "unable to read CSS file '%s': %s\n", path, err.Error())
+			}
+			htmlOpts.css = string(css)
+		},
+		"-template": func(path string) {
+			tmpl, err := template.ParseFiles(path)
+			if err != nil {
+				fail(1, "unable to load HTML template '%s': %s\n", path, err.Error())
+			}
+			htmlOpts.template = tmpl
+		},
+		"-epub-date": func(date string) {
+			t, err := time.Parse(time.RFC3339, date)
+			if err != nil {
+				t, err = time.Parse("2006-01-02", date)
+			}
+			if err != nil {
+				fail(1, "invalid EPUB date '%s', use the form 2006-01-02 or 2006-01-02T15:04:05Z\n", date)
+			}
+			epubModified = t
+		},
+		"-man-section": func(section string) {
+			manOpts.section = section
+		},
+		"-man-date": func(date string) {
+			manOpts.date = date
+		},
+		"-latex-images": func(dir string) {
+			latexOpts.imageDir = dir
+		},
+		"-rtf-config": func(path string) {
+			if err := loadRTFConfig(path, &rtfOpts); err != nil {
+				fail(1, "error in RTF config file '%s': %s\n", path, err.Error())
+			}
+		},
+	}
+
+	for name, set := range rtfOptionSetters {
+		set := set
+		valueOptions["-"+name] = func(value string) {
+			if err := set(&rtfOpts, value); err != nil {
+				fail(1, "%s\n", err.Error())
+			}
+		}
+	}
+
 	args := os.Args[1:]
 	delArg := func(i int) {
 		args = append(args[:i], args[i+1:]...)
@@ -35,13 +221,19 @@ func main() {
 			usage()
 			return
 		}
-		for flag, gen := range generators {
-			if args[i] == flag {
-				generator = gen
-				delArg(i)
-				i--
-				break
+		if gen, ok := generators[args[i]]; ok {
+			generator = gen
+			delArg(i)
+			continue
+		}
+		if setOption, ok := valueOptions[args[i]]; ok {
+			if i+1 >= len(args) {
+				fail(1, "option %s needs a value\n", args[i])
 			}
+			setOption(args[i+1])
+			delArg(i)
+			delArg(i)
+			continue
 		}
 		i++
 	}
@@ -56,6 +248,7 @@ func main() {
 	} else if len(args) == 1 {
 		// read input from file
 		path := args[0]
+		inputPath = path
 		var err error
 		code, err = ioutil.ReadFile(path)
 		if err != nil {
@@ -65,7 +258,7 @@ func main() {
 		fail(1, "too many parameters")
 	}
 
-	doc, err := parse(code)
+	doc, err := parseInput(inputPath, code)
 	if err != nil {
 		fail(2, "error parsing code: %s\n", err.Error())
 	}
@@ -78,6 +271,120 @@ func main() {
 	fmt.Print(string(output))
 }
 
+// formatCommand implements "helpgen fmt".
+func formatCommand(args []string) {
+	check := false
+	var paths []string
+	for _, arg := range args {
+		if isHelpOpt(arg) {
+			usage()
+			return
+		}
+		if arg == "-check" {
+			check = true
+		} else {
+			paths = append(paths, arg)
+		}
+	}
+
+	if len(paths) == 0 {
+		code, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fail(1, "error reading input from STDIN: %s\n", err.Error())
+		}
+		formatted, err := formatHelp(code)
+		if err != nil {
+			fail(2, "error formatting code: %s\n", err.Error())
+		}
+		if check {
+			if !bytes.Equal(code, formatted) {
+				fmt.Println("<stdin>")
+				os.Exit(1)
+			}
+			return
+		}
+		fmt.Print(string(formatted))
+		return
+	}
+
+	unformatted := false
+	for _, path := range paths {
+		code, err := ioutil.ReadFile(path)
+		if err != nil {
+			fail(1, "unable to read file '%s': %s\n", path, err.Error())
+		}
+		formatted, err := formatHelp(code)
+		if err != nil {
+			fail(2, "error formatting '%s': %s\n", path, err.Error())
+		}
+		if bytes.Equal(code, formatted) {
+			continue
+		}
+		if check {
+			fmt.Println(path)
+			unformatted = true
+		} else if err := ioutil.WriteFile(path, formatted, 0666); err != nil {
+			fail(1, "unable to write file '%s': %s\n", path, err.Error())
+		}
+	}
+	if unformatted {
+		os.Exit(1)
+	}
+}
+
+// lintCommand implements "helpgen lint".
+func lintCommand(paths []string) {
+	for _, path := range paths {
+		if isHelpOpt(path) {
+			usage()
+			return
+		}
+	}
+
+	warned := false
+	usedImages := make(map[string]bool)
+	lintFile := func(path string, code []byte) {
+		warnings, images, err := lintHelp(code)
+		if err != nil {
+			fail(2, "%s: %s\n", path, err.Error())
+		}
+		for _, w := range warnings {
+			if w.line > 0 {
+				fmt.Printf("%s:%d: %s\n", path, w.line, w.msg)
+			} else {
+				fmt.Printf("%s: %s\n", path, w.msg)
+			}
+			warned = true
+		}
+		for _, name := range images {
+			usedImages[name] = true
+		}
+	}
+
+	if len(paths) == 0 {
+		code, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fail(1, "error reading input from STDIN: %s\n", err.Error())
+		}
+		lintFile("<stdin>", code)
+	}
+	for _, path := range paths {
+		code, err := ioutil.ReadFile(path)
+		if err != nil {
+			fail(1, "unable to read file '%s': %s\n", path, err.Error())
+		}
+		lintFile(path, code)
+	}
+	for _, path := range unusedImages(".", usedImages) {
+		fmt.Printf("%s: image is not used\n", path)
+		warned = true
+	}
+
+	if warned {
+		os.Exit(1)
+	}
+}
+
 func fail(exitCode int, format string, a ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, a...)
 	os.Exit(exitCode)
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// parseMarkdown converts CommonMark into a document. The first level 1
+// heading becomes the title, later level 1 headings become captions like level
+// 2 headings and levels 5 and 6 become sub-sub-captions. Since documents have
+// no lists or code blocks, list items become lines that start with a bullet or
+// their number and code blocks become lines of literal text.
+func parseMarkdown(code []byte) (document, error) {
+	return parseMarkdownFile("", code)
+}
+
+// parseMarkdownFile is parseMarkdown but records the file name in the source
+// positions of the document parts.
+func parseMarkdownFile(file string, code []byte) (document, error) {
+	m := mdParser{file: file}
+	m.parseBlocks(strings.Split(string(unifyLineBreaks(code)), "\n"))
+	simplifyDoc(&m.doc)
+	if m.err == nil {
+		m.resolveLinks()
+	}
+	return m.doc, m.err
+}
+
+type mdParser struct {
+	doc  document
+	err  error
+	file string
+	// line is the 1-indexed number of the line that is currently parsed
+	line int
+	// hasContent is true if the current block is not the first one after a
+	// caption, so the next block needs a paragraph break
+	hasContent bool
+}
+
+func (m *mdParser) emit(part docPart) {
+	m.doc.parts = append(m.doc.parts, part)
+	// Markdown positions only know the line
+	pos := sourcePos{line: m.line}
+	m.doc.positions = append(m.doc.positions, sourceRange{file: m.file, start: pos, end: pos})
+}
+
+// mdLine is a line of a paragraph or list item, hardBreak is true if it ends
+// in two spaces or a backslash.
+type mdLine struct {
+	text      string
+	number    int
+	hardBreak bool
+}
+
+var (
+	mdATXHeading   = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdSetextH1     = regexp.MustCompile(`^ {0,3}=+[ \t]*$`)
+	mdSetextH2     = regexp.MustCompile(`^ {0,3}-+[ \t]*$`)
+	mdThematic     = regexp.MustCompile(`^ {0,3}((\*[ \t]*){3,}|(-[ \t]*){3,}|(_[ \t]*){3,})$`)
+	mdFence        = regexp.MustCompile("^( {0,3})(```+|~~~+)")
+	mdListItem     = regexp.MustCompile(`^([ \t]*)([-*+]|\d{1,9}[.)])(?:[ \t]+(.*))?$`)
+	mdBlockQuote   = regexp.MustCompile(`^ {0,3}> ?`)
+	mdIndentedCode = regexp.MustCompile(`^(    |\t)`)
+	// mdURLScheme matches the start of absolute URLs like ftp: or tel:
+	mdURLScheme = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+)
+
+func (m *mdParser) parseBlocks(lines []string) {
+	var paragraph []mdLine
+	inList := false
+	flush := func() {
+		if len(paragraph) > 0 {
+			m.paragraph(paragraph)
+		}
+		paragraph = nil
+		inList = false
+	}
+
+	titleDone := false
+	heading := func(level int, text string, number int) {
+		flush()
+		if level == 1 && !titleDone {
+			titleDone = true
+		} else if level == 1 {
+			level = 2
+		} else if level > 4 {
+			level = 4
+		}
+		m.line = number
+		h := splitHeadingID(m.plainText(text))
+		if level == 1 {
+			m.doc.title = h.text
+		}
+		m.emit(withHeading(h, level))
+		m.hasContent = false
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t")
+		number := i + 1
+
+		if fence := mdFence.FindStringSubmatch(lines[i]); fence != nil {
+			flush()
+			indent, marker := len(fence[1]), fence[2]
+			var code []mdLine
+			for i++; i < len(lines); i++ {
+				if strings.HasPrefix(strings.TrimLeft(lines[i], " "), marker) &&
+					strings.Trim(strings.TrimSpace(lines[i]), marker[:1]) == "" {
+					break
+				}
+				text := lines[i]
+				for j := 0; j < indent && strings.HasPrefix(text, " "); j++ {
+					text = text[1:]
+				}
+				code = append(code, mdLine{text: text, number: i + 1})
+			}
+			m.codeBlock(code)
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+
+		if len(paragraph) == 0 && mdIndentedCode.MatchString(lines[i]) {
+			var code []mdLine
+			for ; i < len(lines); i++ {
+				if strings.TrimSpace(lines[i]) == "" {
+					code = append(code, mdLine{number: i + 1})
+				} else if mdIndentedCode.MatchString(lines[i]) {
+					text := strings.TrimPrefix(strings.TrimPrefix(lines[i], "\t"), "    ")
+					code = append(code, mdLine{text: text, number: i + 1})
+				} else {
+					break
+				}
+			}
+			i--
+			// trailing empty lines belong to the next block
+			for len(code) > 0 && code[len(code)-1].text == "" {
+				code = code[:len(code)-1]
+			}
+			m.codeBlock(code)
+			continue
+		}
+
+		if h := mdATXHeading.FindStringSubmatch(line); h != nil {
+			heading(len(h[1]), h[2], number)
+			continue
+		}
+
+		if len(paragraph) > 0 && !inList && (mdSetextH1.MatchString(line) || mdSetextH2.MatchString(line)) {
+			level := 1
+			if strings.Contains(line, "-") {
+				level = 2
+			}
+			texts := make([]string, len(paragraph))
+			for j := range paragraph {
+				texts[j] = strings.TrimSpace(paragraph[j].text)
+			}
+			first := paragraph[0].number
+			paragraph = nil
+			heading(level, strings.Join(texts, " "), first)
+			continue
+		}
+
+		if mdThematic.MatchString(line) {
+			flush()
+			continue
+		}
+
+		if quote := mdBlockQuote.FindString(line); quote != "" {
+			line = line[len(quote):]
+			if strings.TrimSpace(line) == "" {
+				flush()
+				continue
+			}
+		}
+
+		if item := mdListItem.FindStringSubmatch(line); item != nil {
+			if !inList {
+				flush()
+				inList = true
+			}
+			bullet := item[2]
+			if bullet == "-" || bullet == "*" || bullet == "+" {
+				bullet = "•"
+			} else {
+				bullet = strings.TrimRight(bullet, ".)") + "."
+			}
+			indent := strings.Repeat(" ", 2*(len(strings.Replace(item[1], "\t", "    ", -1))/2))
+			if len(paragraph) > 0 {
+				paragraph[len(paragraph)-1].hardBreak = true
+			}
+			paragraph = append(paragraph, mdLine{
+				text:   indent + bullet + " " + item[3],
+				number: number,
+			})
+			continue
+		}
+
+		hardBreak := strings.HasSuffix(lines[i], "  ") || strings.HasSuffix(line, `\`)
+		if strings.HasSuffix(line, `\`) {
+			line = line[:len(line)-1]
+		}
+		paragraph = append(paragraph, mdLine{text: strings.TrimSpace(line), number: number, hardBreak: hardBreak})
+	}
+	flush()
+}
+
+// startBlock separates a new paragraph, list or code block from the one
+// before it.
+func (m *mdParser) startBlock() {
+	if m.hasContent {
+		m.emit(docParagraphBreak{})
+	}
+	m.hasContent = true
+}
+
+func (m *mdParser) paragraph(lines []mdLine) {
+	m.line = lines[0].number
+	m.startBlock()
+	for i, line := range lines {
+		m.line = line.number
+		if i > 0 {
+			if lines[i-1].hardBreak {
+				m.emit(docLineBreak{})
+			} else {
+				m.emit(docText(" "))
+			}
+		}
+		m.inline(line.text, 0)
+	}
+}
+
+// codeBlock writes the lines as they are, without interpreting any markup.
+func (m *mdParser) codeBlock(lines []mdLine) {
+	if len(lines) == 0 {
+		return
+	}
+	m.line = lines[0].number
+	m.startBlock()
+	for i, line := range lines {
+		m.line = line.number
+		if i > 0 {
+			m.emit(docLineBreak{})
+		}
+		if line.text != "" {
+			m.emit(docText(strings.Replace(line.text, "\t", "    ", -1)))
+		}
+	}
+}
+
+// inline parses emphasis, strikethrough, code spans, <kbd> keys, links and
+// images. Emphasis can be nested, the text inside it is parsed with the outer
+// styles added. Links get the style of the surrounding emphasis, the styles
+// inside link texts are removed.
+func (m *mdParser) inline(s string, style textStyle) {
+	var text []byte
+	flushText := func() {
+		if len(text) > 0 {
+			if style != 0 {
+				m.emit(stylizedDocText{text: string(text), style: style})
+			} else {
+				m.emit(docText(text))
+			}
+		}
+		text = nil
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && isASCIIPunct(s[i+1]):
+			text = append(text, s[i+1])
+			i++
+			continue
+
+		case c == '`':
+			n := runLength(s[i:], '`')
+			ticks := strings.Repeat("`", n)
+			end := strings.Index(s[i+n:], ticks)
+			if end != -1 {
+				code := s[i+n : i+n+end]
+				if len(code) >= 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+					code = code[1 : len(code)-1]
+				}
+				flushText()
+				m.emit(docCode(code))
+				i += n + end + n - 1
+				continue
+			}
+			text = append(text, ticks...)
+			i += n - 1
+			continue
+
+		case c == '<' && strings.HasPrefix(s[i:], "<kbd>"):
+			end := strings.Index(s[i:], "</kbd>")
+			if end > len("<kbd>") {
+				flushText()
+				m.emit(docKey(s[i+len("<kbd>") : i+end]))
+				i += end + len("</kbd>") - 1
+				continue
+			}
+			text = append(text, c)
+			continue
+
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			if label, dest, n, ok := parseMDLink(s[i+1:]); ok {
+				flushText()
+				if isURL(dest) {
+					if label == "" {
+						label = dest
+					}
+					m.emit(externalDocLink{url: dest, text: m.plainText(label)})
+				} else {
+					m.emit(docImage{name: path.Base(dest)})
+				}
+				i += n
+				continue
+			}
+
+		case c == '[':
+			if label, dest, n, ok := parseMDLink(s[i:]); ok {
+				flushText()
+				m.link(dest, m.plainText(label), style)
+				i += n - 1
+				continue
+			}
+
+		case c == '<':
+			if end := strings.IndexByte(s[i:], '>'); end > 1 {
+				dest := s[i+1 : i+end]
+				_, mailErr := mail.ParseAddress(dest)
+				if !strings.ContainsAny(dest, " <") && (isURL(dest) || strings.HasPrefix(dest, "mailto:") || mailErr == nil) {
+					flushText()
+					m.link(dest, strings.TrimPrefix(dest, "mailto:"), style)
+					i += end
+					continue
+				}
+			}
+
+		case c == '~' && runLength(s[i:], '~') == 2:
+			// strikethrough like in GitHub Flavored Markdown
+			if i+2 < len(s) && !unicode.IsSpace(rune(s[i+2])) {
+				if end := findMDEmphasisEnd(s[i+2:], '~', 2); end != -1 {
+					flushText()
+					m.inline(s[i+2:i+2+end], style|styleStrike)
+					i += 2 + end + 2 - 1
+					continue
+				}
+			}
+			text = append(text, "~~"...)
+			i++
+			continue
+
+		case c == '*' || c == '_':
+			n := runLength(s[i:], c)
+			if n > 3 {
+				text = append(text, s[i:i+n]...)
+				i += n - 1
+				continue
+			}
+			before := rune(' ')
+			if i > 0 {
+				before = rune(s[i-1])
+			}
+			opens := i+n < len(s) && !unicode.IsSpace(rune(s[i+n]))
+			if c == '_' && isAlnum(before) {
+				// intraword underscores are not emphasis
+				opens = false
+			}
+			if opens {
+				if end := findMDEmphasisEnd(s[i+n:], c, n); end != -1 {
+					flushText()
+					inner := style
+					if n >= 2 {
+						inner |= styleBold
+					}
+					if n != 2 {
+						inner |= styleItalic
+					}
+					m.inline(s[i+n:i+n+end], inner)
+					i += n + end + n - 1
+					continue
+				}
+			}
+			text = append(text, s[i:i+n]...)
+			i += n - 1
+			continue
+		}
+		text = append(text, c)
+	}
+	flushText()
+}
+
+// link emits an internal link for destinations of the form #id and an
+// external link otherwise. Relative links to other files are an error, the
+// document does not contain these files.
+func (m *mdParser) link(dest, text string, style textStyle) {
+	if strings.HasPrefix(dest, "#") {
+		m.emit(tempRef{target: dest[1:], text: text, declLine: m.line, style: style})
+		return
+	}
+	url := dest
+	if strings.HasPrefix(url, "www.") {
+		url = "http://" + url
+	} else if !isURL(url) && !strings.HasPrefix(url, "mailto:") {
+		if _, err := mail.ParseAddress(url); err == nil {
+			url = "mailto:" + url
+		} else if !mdURLScheme.MatchString(url) {
+			if m.err == nil {
+				m.err = fmt.Errorf(
+					"relative link '%s' in line %d cannot be converted, link to a caption with #id or use an absolute URL",
+					dest, m.line,
+				)
+			}
+			return
+		}
+	}
+	if text == "" {
+		text = dest
+	}
+	m.emit(externalDocLink{url: url, text: text, style: style})
+}
+
+// plainText returns the text of inline markup without its styles.
+func (m *mdParser) plainText(s string) string {
+	var sub mdParser
+	sub.inline(s, 0)
+	var text []string
+	for _, part := range sub.doc.parts {
+		switch p := part.(type) {
+		case docText:
+			text = append(text, string(p))
+		case stylizedDocText:
+			text = append(text, p.text)
+		case docCode:
+			text = append(text, string(p))
+		case docKey:
+			text = append(text, string(p))
+		case tempRef:
+			text = append(text, p.text)
+		case externalDocLink:
+			text = append(text, p.text)
+		}
+	}
+	return strings.Join(text, "")
+}
+
+// resolveLinks gives all captions ids and turns links to #id into links to
+// these captions. Besides the caption ids, the anchors that GitHub generates
+// for headings are accepted, so links in README files keep working.
+func (m *mdParser) resolveLinks() {
+	p := parser{doc: m.doc}
+	p.assignIDs()
+	if p.err != nil {
+		m.err = p.err
+		return
+	}
+	ids := make(map[string]string)
+	slugCount := make(map[string]int)
+	for _, part := range p.doc.parts {
+		if h, _, ok := headingOf(part); ok {
+			base := gfmSlug(h.text)
+			slug := base
+			if n := slugCount[base]; n > 0 {
+				slug = fmt.Sprintf("%s-%d", base, n)
+			}
+			slugCount[base]++
+			if _, exists := ids[slug]; !exists {
+				ids[slug] = h.id
+			}
+		}
+	}
+	// caption ids take precedence over GitHub anchors
+	for _, part := range p.doc.parts {
+		if h, _, ok := headingOf(part); ok {
+			ids[h.id] = h.id
+		}
+	}
+	for i, part := range p.doc.parts {
+		if ref, ok := part.(tempRef); ok {
+			id, ok := ids[ref.target]
+			if !ok {
+				m.err = fmt.Errorf("unknown link target '#%s' in line %d", ref.target, ref.declLine)
+				return
+			}
+			text := ref.text
+			if text == "" {
+				text = ref.target
+			}
+			p.doc.parts[i] = docLink{id: id, text: text, style: ref.style}
+		}
+	}
+	m.doc = p.doc
+}
+
+// gfmSlug returns the anchor that GitHub generates for a heading: the lower
+// case text without punctuation except '-' and '_', spaces become '-'. Repeated
+// anchors get the suffixes -1, -2 and so on.
+func gfmSlug(text string) string {
+	var slug []rune
+	for _, r := range strings.ToLower(text) {
+		if r == ' ' {
+			slug = append(slug, '-')
+		} else if isAlnum(r) || unicode.IsMark(r) || r == '-' || r == '_' {
+			slug = append(slug, r)
+		}
+	}
+	return string(slug)
+}
+
+// parseMDLink parses a link of the form [label](destination "title") at the
+// start of s and returns its length in bytes.
+func parseMDLink(s string) (label, dest string, n int, ok bool) {
+	depth := 0
+	labelEnd := -1
+	for i := 0; i < len(s) && labelEnd == -1; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				labelEnd = i
+			}
+		}
+	}
+	if labelEnd == -1 || labelEnd+1 >= len(s) || s[labelEnd+1] != '(' {
+		return
+	}
+	end := strings.IndexByte(s[labelEnd:], ')')
+	if end == -1 {
+		return
+	}
+	end += labelEnd
+	inside := strings.TrimSpace(s[labelEnd+2 : end])
+	if strings.HasPrefix(inside, "<") {
+		if close := strings.IndexByte(inside, '>'); close != -1 {
+			inside = inside[1:close]
+		}
+	} else if space := strings.IndexAny(inside, " \t"); space != -1 {
+		// drop the optional title
+		inside = inside[:space]
+	}
+	return s[1:labelEnd], inside, end + 1, true
+}
+
+// findMDEmphasisEnd returns the index of the closing delimiter run of n
+// delimiters in s, or -1 if there is none.
+func findMDEmphasisEnd(s string, delim byte, n int) int {
+	for i := 1; i < len(s); i++ {
+		if s[i] == '`' {
+			// code spans cannot contain the end of emphasis
+			run := runLength(s[i:], '`')
+			if end := strings.Index(s[i+run:], strings.Repeat("`", run)); end != -1 {
+				i += run + end + run - 1
+				continue
+			}
+		}
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] != delim {
+			continue
+		}
+		run := runLength(s[i:], delim)
+		if run == n && !unicode.IsSpace(rune(s[i-1])) {
+			after := i + run
+			if delim == '*' || after >= len(s) || !isAlnum(rune(s[after])) {
+				return i
+			}
+		}
+		i += run - 1
+	}
+	return -1
+}
+
+func runLength(s string, c byte) int {
+	n := 0
+	for n < len(s) && s[n] == c {
+		n++
+	}
+	return n
+}
+
+func isASCIIPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) != -1
+}
+
+func isAlnum(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") ||
+		strings.HasPrefix(s, "https://") ||
+		strings.HasPrefix(s, "www.")
+}
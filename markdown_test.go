@@ -0,0 +1,201 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarkdownHeadings(t *testing.T) {
+	checkMarkdown(t, `# Title
+## Caption ##
+### Sub
+#### Sub sub
+##### Deep
+Second
+======
+Setext
+------`,
+		"Title",
+		docTitle{text: "Title", id: "title"},
+		docCaption{text: "Caption", id: "caption"},
+		docSubCaption{text: "Sub", id: "sub"},
+		docSubSubCaption{text: "Sub sub", id: "sub-sub"},
+		docSubSubCaption{text: "Deep", id: "deep"},
+		docCaption{text: "Second", id: "second"},
+		docCaption{text: "Setext", id: "setext"},
+	)
+}
+
+func TestMarkdownParagraphs(t *testing.T) {
+	checkMarkdown(t, `one
+two  
+three\
+four
+
+five`,
+		"",
+		docText("one two"),
+		docLineBreak{},
+		docText("three"),
+		docLineBreak{},
+		docText("four"),
+		docParagraphBreak{},
+		docText("five"),
+	)
+}
+
+func TestMarkdownEmphasis(t *testing.T) {
+	checkMarkdown(t, `*a* _b_ **c** __d__ ***e*** **f *g* h** snake_case_name 2*3*4 \*x\* `+"`*code*`",
+		"",
+		italic("a"),
+		docText(" "),
+		italic("b"),
+		docText(" "),
+		bold("c"),
+		docText(" "),
+		bold("d"),
+		docText(" "),
+		boldItalic("e"),
+		docText(" "),
+		bold("f "),
+		boldItalic("g"),
+		bold(" h"),
+		docText(" snake_case_name 2"),
+		italic("3"),
+		docText("4 *x* "),
+		docCode("*code*"),
+	)
+}
+
+func TestMarkdownStrikethrough(t *testing.T) {
+	checkMarkdown(t, "~~old~~ **~~both~~** a~~b", "",
+		styled("old", styleStrike),
+		docText(" "),
+		styled("both", styleBold|styleStrike),
+		docText(" a~~b"),
+	)
+}
+
+func TestMarkdownKbdElementsAreKeys(t *testing.T) {
+	checkMarkdown(t, "Press <kbd>F1</kbd> for <b>help</b>", "",
+		docText("Press "),
+		docKey("F1"),
+		docText(" for <b>help</b>"),
+	)
+}
+
+func TestMarkdownLinksKeepTheSurroundingStyle(t *testing.T) {
+	checkMarkdown(t, "# A\n**see [A](#a) and [site](http://a.b)**", "A",
+		docTitle{text: "A", id: "a"},
+		bold("see "),
+		docLink{id: "a", text: "A", style: styleBold},
+		bold(" and "),
+		externalDocLink{url: "http://a.b", text: "site", style: styleBold},
+	)
+}
+
+func TestMarkdownLinksAndImages(t *testing.T) {
+	checkMarkdown(t, `# Title
+See [the *title*](#title), [site](https://example.com "Example"), <http://a.b>, <me@example.com> and ![logo](img/logo.png).`,
+		"Title",
+		docTitle{text: "Title", id: "title"},
+		docText("See "),
+		docLink{id: "title", text: "the title"},
+		docText(", "),
+		externalDocLink{url: "https://example.com", text: "site"},
+		docText(", "),
+		externalDocLink{url: "http://a.b", text: "http://a.b"},
+		docText(", "),
+		externalDocLink{url: "mailto:me@example.com", text: "me@example.com"},
+		docText(" and "),
+		docImage{name: "logo.png"},
+		docText("."),
+	)
+}
+
+func TestMarkdownListsAndCode(t *testing.T) {
+	checkMarkdown(t, "- one\n- two\n  - nested\n1. first\n\n```go\nx := *p\n\n  y\n```\n\n    indented [x]",
+		"",
+		docText("• one"),
+		docLineBreak{},
+		docText("• two"),
+		docLineBreak{},
+		docText("  • nested"),
+		docLineBreak{},
+		docText("1. first"),
+		docParagraphBreak{},
+		docText("x := *p"),
+		docLineBreak{},
+		docLineBreak{},
+		docText("  y"),
+		docParagraphBreak{},
+		docText("indented [x]"),
+	)
+}
+
+func TestMarkdownUnknownAnchorIsAnError(t *testing.T) {
+	_, err := parseMarkdown([]byte("# A\n\n[link](#b)"))
+	if err == nil || err.Error() != "unknown link target '#b' in line 3" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMarkdownLinksCanUseGitHubAnchors(t *testing.T) {
+	checkMarkdown(t, `# Read_me
+## Set up & run
+## Set up & run
+See [a](#read_me), [b](#set-up--run), [c](#set-up--run-1) and [d](#set-up-run).`,
+		"Read_me",
+		docTitle{text: "Read_me", id: "read-me"},
+		docCaption{text: "Set up & run", id: "set-up-run"},
+		docCaption{text: "Set up & run", id: "set-up-run-2"},
+		docText("See "),
+		docLink{id: "read-me", text: "a"},
+		docText(", "),
+		docLink{id: "set-up-run", text: "b"},
+		docText(", "),
+		docLink{id: "set-up-run-2", text: "c"},
+		docText(" and "),
+		docLink{id: "set-up-run", text: "d"},
+		docText("."),
+	)
+}
+
+func TestMarkdownRelativeLinksAreAnError(t *testing.T) {
+	for _, link := range []string{"setup.md", "other.md#part", "../docs/"} {
+		_, err := parseMarkdown([]byte("# A\n\ntext\n[link](" + link + ")"))
+		want := "relative link '" + link + "' in line 4 cannot be converted, link to a caption with #id or use an absolute URL"
+		if err == nil || err.Error() != want {
+			t.Errorf("%s: unexpected error: %v", link, err)
+		}
+	}
+	checkMarkdown(t, "[call](tel:123)", "", externalDocLink{url: "tel:123", text: "call"})
+}
+
+func TestMarkdownRecordsLines(t *testing.T) {
+	doc, err := parseMarkdown([]byte("# A\n\ntext\nmore\n\n## B"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []int
+	for _, pos := range doc.positions {
+		lines = append(lines, pos.start.line)
+	}
+	if want := []int{1, 3, 6}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("want lines %v but have %v", want, lines)
+	}
+}
+
+func checkMarkdown(t *testing.T, code string, title string, want ...docPart) {
+	t.Helper()
+	doc, err := parseMarkdown([]byte(code))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	if doc.title != title {
+		t.Errorf("wrong title, want %s, got %s", title, doc.title)
+	}
+	if !reflect.DeepEqual(doc.parts, want) {
+		t.Errorf("want\n%#v\nbut have\n%#v", want, doc.parts)
+	}
+}
@@ -4,12 +4,21 @@ import (
 	"bytes"
 	"fmt"
 	"net/mail"
+	"sort"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 func parse(code []byte) (document, error) {
+	return parseFile("", code)
+}
+
+// parseFile parses the code and records the file name in the source
+// positions of the document parts.
+func parseFile(file string, code []byte) (document, error) {
 	var p parser
+	p.file = file
 	p.code = code
 	p.parse()
 	if p.err == nil {
@@ -23,6 +32,25 @@ type parser struct {
 	err  error
 	code []byte
 	vars varTable
+	// file is the name of the source file, it is stored with the source
+	// position of every emitted part
+	file string
+	// warn, if not nil, is called for markup that is valid but probably not
+	// what the author meant
+	warn func(line int, msg string)
+	// notes are the footnote definitions by name, inFootnote is true while
+	// the content of a footnote is parsed
+	notes      map[string]*footnote
+	inFootnote bool
+}
+
+// footnote is the definition of a footnote. refLine is the line of its
+// reference or 0 if it was not referenced yet, each footnote is referenced
+// exactly once.
+type footnote struct {
+	content  document
+	declLine int
+	refLine  int
 }
 
 type varTable map[string]variable
@@ -54,15 +82,25 @@ func (p *parser) parse() {
 	if p.err != nil {
 		return
 	}
+	lines = p.extractFootnotes(lines)
+	if p.err != nil {
+		return
+	}
 	p.parseLines(lines)
 	if p.err != nil {
 		return
 	}
+	p.checkFootnotesUsed()
+	if p.err != nil {
+		return
+	}
 	simplifyDoc(&p.doc)
 }
 
-func (p *parser) emit(part docPart) {
+// emit appends a part to the document, start and end are its source range.
+func (p *parser) emit(part docPart, start, end sourcePos) {
 	p.doc.parts = append(p.doc.parts, part)
+	p.doc.positions = append(p.doc.positions, sourceRange{file: p.file, start: start, end: end})
 }
 
 // unifyLineBreaks replaces all \r\n and \r with \n
@@ -120,7 +158,8 @@ func extractVariableDefinitions(lines []codeLine) ([]codeLine, varTable, error)
 				if validVarName(name) {
 					// make sure each variable is only defined once
 					if v, exists := vars[name]; exists {
-						return nil, nil, fmt.Errorf(
+						return nil, nil, errorInLine(
+							lines[i].number,
 							"variable '%s' redefined in line %d, first definition was in line %d, each variable can only be defined once",
 							name,
 							lines[i].number,
@@ -143,6 +182,190 @@ func extractVariableDefinitions(lines []codeLine) ([]codeLine, varTable, error)
 	return lines, vars, nil
 }
 
+// footnoteDefinition returns the name of the footnote that the line defines
+// and the offset of the footnote's text. Footnotes are defined in lines of the
+// form "[^name]: text", the text can go on in the following lines.
+func footnoteDefinition(line []byte) (name string, textStart int, ok bool) {
+	if !bytes.HasPrefix(line, []byte("[^")) {
+		return "", 0, false
+	}
+	end := bytes.Index(line, []byte("]:"))
+	if end == -1 || !validID(string(line[2:end])) {
+		return "", 0, false
+	}
+	textStart = end + 2
+	for textStart < len(line) && isSpace(line[textStart]) {
+		textStart++
+	}
+	return string(line[2:end]), textStart, true
+}
+
+// extractFootnotes parses and removes all footnote definitions. A definition
+// ends at the next empty line, the next definition, a caption or an admonition
+// line. It cannot interrupt a paragraph, there has to be an empty line before
+// it, otherwise the text after it would most likely be taken for a part of the
+// footnote.
+func (p *parser) extractFootnotes(lines []codeLine) []codeLine {
+	p.notes = make(map[string]*footnote)
+	var rest []codeLine
+	inNote := false
+	for i := 0; i < len(lines); i++ {
+		name, textStart, ok := footnoteDefinition(lines[i].text)
+		if !ok {
+			rest = append(rest, lines[i])
+			inNote = false
+			continue
+		}
+		if i > 0 && !inNote && interruptsParagraph(lines[i-1], lines[i]) {
+			p.err = errorInLine(
+				lines[i].number,
+				"footnote '%s' in line %d interrupts the paragraph in line %d, add an empty line before its definition",
+				name, lines[i].number, lines[i-1].number,
+			)
+			return nil
+		}
+		inNote = true
+		if note, exists := p.notes[name]; exists {
+			p.err = errorInLine(
+				lines[i].number,
+				"footnote '%s' redefined in line %d, first definition was in line %d, each footnote can only be defined once",
+				name, lines[i].number, note.declLine,
+			)
+			return nil
+		}
+		first := lines[i]
+		text := []codeLine{{text: first.text[textStart:], number: first.number}}
+		for i+1 < len(lines) && !endsFootnote(lines, i+1) {
+			i++
+			text = append(text, lines[i])
+		}
+
+		content := parser{code: p.code, vars: p.vars, file: p.file, warn: p.warn, inFootnote: true}
+		content.parseLines(text)
+		if content.err != nil {
+			p.err = content.err
+			return nil
+		}
+		simplifyDoc(&content.doc)
+		if len(content.doc.parts) == 0 {
+			p.err = errorInLine(first.number, "footnote '%s' in line %d has no text", name, first.number)
+			return nil
+		}
+		for _, part := range content.doc.parts {
+			switch part.(type) {
+			case docParagraphBreak, docAdmonition, docTitle, docCaption, docSubCaption, docSubSubCaption:
+				p.err = errorInLine(
+					first.number,
+					"footnote '%s' in line %d can only contain text, no paragraphs, captions or admonitions",
+					name, first.number,
+				)
+				return nil
+			}
+		}
+		// the columns in the first line start after the "[^name]:"
+		offset := utf8.RuneCount(first.text[:textStart])
+		for j := range content.doc.positions {
+			pos := &content.doc.positions[j]
+			if pos.start.line == first.number {
+				pos.start.column += offset
+			}
+			if pos.end.line == first.number {
+				pos.end.column += offset
+			}
+		}
+		p.notes[name] = &footnote{content: content.doc, declLine: first.number}
+	}
+	return rest
+}
+
+// endsFootnote returns true if lines[i] is not part of the footnote definition
+// in the lines before it.
+func endsFootnote(lines []codeLine, i int) bool {
+	line := lines[i]
+	_, _, isDefinition := footnoteDefinition(line.text)
+	isCaption := i+1 < len(lines) && lines[i+1].kind != textLine
+	return lineEmpty(line) || isDefinition || line.kind != textLine || isCaption ||
+		isAdmonitionLine(line)
+}
+
+// interruptsParagraph returns true if the footnote definition in line directly
+// follows the text of a paragraph in prev.
+func interruptsParagraph(prev, line codeLine) bool {
+	return prev.number == line.number-1 && prev.kind == textLine && !lineEmpty(prev) &&
+		!isAdmonitionLine(prev)
+}
+
+func lineEmpty(line codeLine) bool {
+	return len(bytes.TrimSpace(line.text)) == 0
+}
+
+// isAdmonitionLine returns true if the line starts or ends an admonition.
+func isAdmonitionLine(line codeLine) bool {
+	_, _, isStart := admonitionKindOf(line)
+	return isStart || string(bytes.TrimSpace(line.text)) == admonitionEnd
+}
+
+// footnoteRef returns the footnote that a reference of the form [^name]
+// refers to. Footnotes are numbered in the order of their references.
+func (p *parser) footnoteRef(name string, line int) docPart {
+	note, ok := p.notes[name]
+	switch {
+	case p.inFootnote:
+		p.setErr(errorInLine(line, "footnote '%s' is used in a footnote in line %d, footnotes cannot be nested", name, line))
+	case !ok:
+		p.setErr(errorInLine(line, "footnote '%s' in line %d is not defined, define it in a line starting with [^%s]:", name, line, name))
+	case note.refLine != 0:
+		p.setErr(errorInLine(line, "footnote '%s' is used in line %d and line %d, each footnote can only be used once", name, note.refLine, line))
+	default:
+		note.refLine = line
+		number := 0
+		for _, n := range p.notes {
+			if n.refLine != 0 {
+				number++
+			}
+		}
+		return docFootnote{number: number, content: note.content}
+	}
+	return docText("")
+}
+
+// checkFootnotesUsed makes sure that every footnote is referenced. The first
+// unused definition is reported.
+func (p *parser) checkFootnotesUsed() {
+	var unused *footnote
+	var unusedName string
+	for name, note := range p.notes {
+		if note.refLine == 0 && (unused == nil || note.declLine < unused.declLine) {
+			unused, unusedName = note, name
+		}
+	}
+	if unused != nil {
+		p.err = errorInLine(unused.declLine, "footnote '%s' defined in line %d is never used", unusedName, unused.declLine)
+	}
+}
+
+// lineError is an error in a line of the source code, editors mark that line.
+type lineError struct {
+	line int // 1-indexed
+	msg  string
+}
+
+func (e lineError) Error() string {
+	return e.msg
+}
+
+// errorInLine creates a lineError with a formatted message.
+func errorInLine(line int, format string, args ...interface{}) error {
+	return lineError{line: line, msg: fmt.Sprintf(format, args...)}
+}
+
+// setErr keeps the first error that occurs.
+func (p *parser) setErr(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
 // validVarName returns true if the name is not empty and contains only letters,
 // digits or underscores
 func validVarName(name string) bool {
@@ -155,26 +378,94 @@ func validVarName(name string) bool {
 }
 
 func simplifyDoc(doc *document) {
-	// combine all neighbor pairs of docText into one
-	for i := 0; i < len(doc.parts)-1; i++ {
-		a, aIsText := doc.parts[i].(docText)
-		b, bIsText := doc.parts[i+1].(docText)
-		if aIsText && bIsText {
-			doc.parts[i] = a + b
-			doc.parts = append(doc.parts[:i+1], doc.parts[i+2:]...)
-			i--
+	// combine all neighbor pairs of docText or of stylizedDocText with the
+	// same style into one, in a single pass so long documents stay fast
+	n, positions := 0, 0
+	for i, part := range doc.parts {
+		if n > 0 {
+			if merged, ok := mergeText(doc.parts[n-1], part); ok {
+				doc.parts[n-1] = merged
+				if i < len(doc.positions) {
+					doc.positions[n-1].end = doc.positions[i].end
+				}
+				continue
+			}
+		}
+		doc.parts[n] = part
+		if i < len(doc.positions) {
+			doc.positions[n] = doc.positions[i]
+			positions = n + 1
 		}
+		n++
 	}
+	doc.parts = doc.parts[:n]
+	doc.positions = doc.positions[:positions]
+}
+
+// mergeText joins two texts of the same style.
+func mergeText(a, b docPart) (docPart, bool) {
+	switch a := a.(type) {
+	case docText:
+		if b, ok := b.(docText); ok {
+			return a + b, true
+		}
+	case stylizedDocText:
+		if b, ok := b.(stylizedDocText); ok && a.style == b.style {
+			return stylizedDocText{text: a.text + b.text, style: a.style}, true
+		}
+	}
+	return nil, false
 }
 
 func (p *parser) parseLines(lines []codeLine) {
-	lineEmpty := func(line codeLine) bool {
-		return len(bytes.TrimSpace(line.text)) == 0
+	// inParagraph is true after text was emitted for the current paragraph,
+	// newParagraph is true if an empty line followed that text and hardBreak
+	// is true if the last text line ended in a backslash
+	inParagraph, newParagraph, hardBreak := false, false, false
+	endParagraph := func() {
+		inParagraph, newParagraph, hardBreak = false, false, false
+	}
+	// hardBreakPos is the position of the backslash that forces a line break
+	var hardBreakPos sourcePos
+	// segment collects the lines of text up to the next hard line break,
+	// styles can span the soft line breaks between them
+	var segment []codeLine
+	flushSegment := func() {
+		if len(segment) > 0 {
+			p.parseInline(segment)
+		}
+		segment = nil
+	}
+	// emitCaption emits a caption that spans the whole line
+	emitCaption := func(part docPart, line codeLine) {
+		text := bytes.TrimRight(line.text, " \t")
+		p.emit(part,
+			sourcePos{line: line.number, column: 1},
+			sourcePos{line: line.number, column: utf8.RuneCount(text) + 1},
+		)
 	}
 
 	// there can only be one title, having multiple titles is an error
 	titleLine := -1
-	for i, line := range lines {
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if kind, ok := p.admonitionStart(line); ok {
+			end := p.findAdmonitionEnd(lines, i, kind)
+			if p.err != nil {
+				return
+			}
+			flushSegment()
+			endParagraph()
+			p.parseAdmonition(kind, lines[i:end+1])
+			if p.err != nil {
+				return
+			}
+			i = end
+			continue
+		}
+		if p.err != nil {
+			return
+		}
 		if line.kind == textLine {
 			empty := lineEmpty(line)
 			precededByEqualsLine := i > 0 && lines[i-1].kind == equalsLine
@@ -186,105 +477,451 @@ func (p *parser) parseLines(lines []codeLine) {
 			if potentialTitle && (i == 1 || lines[i-2].kind != textLine || lineEmpty(lines[i-2])) {
 				// this is the document title, there can only be one
 				if titleLine != -1 {
-					p.err = fmt.Errorf("title redefined in line %d, first definition in line %d, there can only be one title", i+1, titleLine+1)
+					p.err = errorInLine(
+						line.number,
+						"title redefined in line %d, first definition in line %d, there can only be one title",
+						line.number, lines[titleLine].number,
+					)
 					return
 				}
 				titleLine = i
-				p.doc.title = p.replaceVars(string(line.text))
-				p.emit(docTitle(p.doc.title))
+				flushSegment()
+				endParagraph()
+				h := p.parseHeading(line)
+				p.doc.title = h.text
+				emitCaption(docTitle(h), line)
 			} else if !empty && followedByEqualsLine {
-				p.emit(docCaption(p.replaceVars(string(line.text))))
+				flushSegment()
+				endParagraph()
+				emitCaption(docCaption(p.parseHeading(line)), line)
 			} else if !empty && followedByMinusLine {
-				p.emit(docSubCaption(p.replaceVars(string(line.text))))
+				p.warnCaptionAfterText(lines, i)
+				flushSegment()
+				endParagraph()
+				emitCaption(docSubCaption(p.parseHeading(line)), line)
 			} else if !empty && followedByDottedLine {
-				p.emit(docSubSubCaption(p.replaceVars(string(line.text))))
+				p.warnCaptionAfterText(lines, i)
+				flushSegment()
+				endParagraph()
+				emitCaption(docSubSubCaption(p.parseHeading(line)), line)
+			} else if empty {
+				if inParagraph {
+					flushSegment()
+					newParagraph = true
+				}
 			} else {
-				p.parseLine(line.text, line.number)
-				if i != len(lines)-1 {
-					p.emit(docText("\n"))
+				// consecutive lines of text form a paragraph, they are joined
+				// with a space unless the line ends in a backslash, which
+				// forces a line break
+				lineStart := sourcePos{line: line.number, column: 1}
+				if newParagraph {
+					p.emit(docParagraphBreak{}, lineStart, lineStart)
+					endParagraph()
+				} else if inParagraph && hardBreak {
+					p.emit(docLineBreak{}, hardBreakPos, sourcePos{hardBreakPos.line, hardBreakPos.column + 1})
+				}
+				text := bytes.TrimRight(line.text, " \t")
+				hardBreak = text[len(text)-1] == '\\'
+				if hardBreak {
+					hardBreakPos = sourcePos{line: line.number, column: utf8.RuneCount(text)}
+					text = bytes.TrimRight(text[:len(text)-1], " \t")
 				}
+				segment = append(segment, codeLine{text: text, number: line.number})
+				if hardBreak {
+					flushSegment()
+				}
+				inParagraph = true
 			}
 		}
 	}
+	flushSegment()
+}
+
+// admonitionEnd is the line that closes an admonition.
+const admonitionEnd = "!!!"
+
+// admonitionStart returns the kind of admonition that the line starts. An
+// admonition starts with a line like "!!! warning" and ends with a line "!!!".
+// A line with an unknown kind, like "!!! IMPORTANT !!!", is normal text, lint
+// warns about it in case it is a misspelled kind.
+func (p *parser) admonitionStart(line codeLine) (admonitionKind, bool) {
+	kind, name, ok := admonitionKindOf(line)
+	if !ok && name != "" && p.warn != nil {
+		var names []string
+		for _, kind := range admonitionKinds {
+			names = append(names, string(kind))
+		}
+		p.warn(line.number, fmt.Sprintf(
+			"'%s' is not an admonition and stays as text, use one of: %s",
+			name, strings.Join(names, ", "),
+		))
+	}
+	return kind, ok
+}
+
+// admonitionKindOf returns the kind of admonition that the line starts and
+// whether it is known. name is the text after "!!! ", it is empty if the line
+// does not start with "!!! ".
+func admonitionKindOf(line codeLine) (kind admonitionKind, name string, ok bool) {
+	text := string(bytes.TrimSpace(line.text))
+	if !strings.HasPrefix(text, admonitionEnd+" ") {
+		return "", "", false
+	}
+	name = strings.TrimSpace(text[len(admonitionEnd):])
+	kind, ok = findAdmonitionKind(name)
+	return kind, name, ok
 }
 
-func (p *parser) parseLine(line []byte, lineNumber int) {
-	if len(line) == 0 {
+// findAdmonitionEnd returns the index of the line that closes the admonition
+// starting at lines[start]. Admonitions cannot be nested.
+func (p *parser) findAdmonitionEnd(lines []codeLine, start int, kind admonitionKind) int {
+	for i := start + 1; i < len(lines); i++ {
+		if string(bytes.TrimSpace(lines[i].text)) == admonitionEnd {
+			return i
+		}
+		if _, _, ok := admonitionKindOf(lines[i]); ok {
+			p.err = errorInLine(
+				lines[i].number,
+				"admonition in line %d is inside the %s in line %d, admonitions cannot be nested",
+				lines[i].number, kind, lines[start].number,
+			)
+			return -1
+		}
+	}
+	p.err = errorInLine(
+		lines[start].number,
+		"%s in line %d is not closed, end it with a line '%s'",
+		kind, lines[start].number, admonitionEnd,
+	)
+	return -1
+}
+
+// parseAdmonition parses the content between the first and last of the lines
+// into a document of its own and emits the admonition.
+func (p *parser) parseAdmonition(kind admonitionKind, lines []codeLine) {
+	content := parser{code: p.code, vars: p.vars, file: p.file, warn: p.warn, notes: p.notes}
+	content.parseLines(lines[1 : len(lines)-1])
+	if content.err != nil {
+		p.err = content.err
 		return
 	}
+	for i, part := range content.doc.parts {
+		if _, _, ok := headingOf(part); ok {
+			p.err = errorInLine(
+				content.doc.position(i).start.line,
+				"caption in line %d is inside the %s in line %d, admonitions cannot contain captions",
+				content.doc.position(i).start.line, kind, lines[0].number,
+			)
+			return
+		}
+	}
+	simplifyDoc(&content.doc)
+	first, last := lines[0], lines[len(lines)-1]
+	p.emit(docAdmonition{kind: kind, content: content.doc},
+		sourcePos{line: first.number, column: 1},
+		sourcePos{line: last.number, column: utf8.RuneCount(bytes.TrimRight(last.text, " \t")) + 1},
+	)
+}
 
-	i := 0
-	for i < len(line) {
-		switch line[i] {
-		case '*', '/':
-			delim := line[i]
-			if i+1 < len(line) && !isSpace(line[i+1]) {
-				end := findStyleEnd(line[i+1:], delim)
-				if end != -1 {
-					end += i + 1 // because index was for line[i+1:]
-					if i > 0 {
-						p.emit(docText(line[:i]))
-					}
-					text := string(line[i+1 : end-1])
-					bold := delim == '*'
-					italic := delim == '/'
-					// account for both styles at once
-					if bold && strings.HasPrefix(text, "/") && strings.HasSuffix(text, "/") {
-						italic = true
-						text = text[1 : len(text)-1]
-					}
-					if italic && strings.HasPrefix(text, "*") && strings.HasSuffix(text, "*") {
-						bold = true
-						text = text[1 : len(text)-1]
-					}
-					text = p.replaceVars(text)
-					p.emit(stylizedDocText{
-						bold:   bold,
-						italic: italic,
-						text:   text,
-					})
-					i = 0
-					line = line[end:]
-					continue
+// warnCaptionAfterText warns about a line of - or . characters below a
+// paragraph, which makes the paragraph's last line a caption. Most likely it
+// was meant as a separator or as part of the text.
+func (p *parser) warnCaptionAfterText(lines []codeLine, i int) {
+	if p.warn != nil && i > 0 && lines[i-1].kind == textLine && len(bytes.TrimSpace(lines[i-1].text)) > 0 {
+		p.warn(lines[i+1].number, fmt.Sprintf(
+			"the underline makes line %d the caption '%s', add an empty line before it if this is intended",
+			lines[i].number, strings.TrimSpace(string(lines[i].text)),
+		))
+	}
+}
+
+// parseHeading replaces variables in a caption line and splits off an
+// optional explicit id, which is given in the form {#id} at the end of the
+// line. All captions without an explicit id get an id generated from their
+// text in assignIDs.
+func (p *parser) parseHeading(line codeLine) heading {
+	return splitHeadingID(p.replaceVars(string(line.text)))
+}
+
+// splitHeadingID splits the optional {#id} suffix off a caption text and trims
+// trailing white space.
+func splitHeadingID(text string) heading {
+	trimmed := strings.TrimRightFunc(text, unicode.IsSpace)
+	if strings.HasSuffix(trimmed, "}") {
+		start := strings.LastIndex(trimmed, "{#")
+		if start != -1 {
+			id := trimmed[start+2 : len(trimmed)-1]
+			if validID(id) {
+				return heading{
+					text: strings.TrimRightFunc(trimmed[:start], unicode.IsSpace),
+					id:   id,
 				}
 			}
-		case '[':
-			ok, ref, subRef, rest := findRefEnd(line[i+1:])
-			if ok {
-				if i > 0 {
-					p.emit(docText(line[:i]))
-				}
+		}
+	}
+	return heading{text: trimmed}
+}
 
-				if subRef != "" {
-					p.emit(tempRef{
-						text:     ref,
-						target:   subRef,
-						declLine: lineNumber,
-					})
-				} else if v, ok := p.vars[ref]; ok {
-					p.emit(docText(v.text))
-				} else if len(ref) == 1 && strings.Contains("[*/=-.", ref) {
-					p.emit(docText(ref))
-				} else if hasImageExt(ref) {
-					p.emit(docImage{name: ref})
-				} else {
-					p.emit(tempRef{
-						target:   ref,
-						declLine: lineNumber,
-					})
-				}
+// validID returns true if id is not empty and only contains letters, digits,
+// '-', '_' and '.'
+func validID(id string) bool {
+	for _, r := range id {
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.", r)) {
+			return false
+		}
+	}
+	return id != ""
+}
+
+// slug creates an id from a caption text. It consists of the lower case
+// letters and digits of the text, all other characters are collapsed into
+// single '-' characters.
+func slug(text string) string {
+	var id []rune
+	dash := false
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && len(id) > 0 {
+				id = append(id, '-')
+			}
+			id = append(id, r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if len(id) == 0 {
+		return "section"
+	}
+	return string(id)
+}
+
+// parseInline parses the text of the lines, which are joined by soft line
+// breaks. Styled text can contain other styles, links, images and code.
+func (p *parser) parseInline(lines []codeLine) {
+	in := inlineParser{p: p}
+	for i, line := range lines {
+		if i > 0 {
+			in.text = append(in.text, '\n')
+		}
+		in.starts = append(in.starts, len(in.text))
+		in.numbers = append(in.numbers, line.number)
+		in.text = append(in.text, line.text...)
+	}
+	for _, part := range in.parse(0, len(in.text), 0) {
+		p.emit(part.part, in.pos(part.from), in.pos(part.to))
+	}
+}
+
+// inlineParser parses the text of a paragraph up to the next hard line break.
+// The lines of text are joined with '\n', which becomes a space in the output.
+type inlineParser struct {
+	p    *parser
+	text []byte
+	// starts are the offsets of the lines in text, numbers are their line
+	// numbers in the source code
+	starts  []int
+	numbers []int
+}
+
+// inlinePart is a docPart and its byte range in the inline text.
+type inlinePart struct {
+	part     docPart
+	from, to int
+}
+
+// parse parses text[start:end] with the given style. A style ends at the next
+// closing delimiter of the same kind. Styles inside it have to end before
+// that, otherwise their delimiters are used literally, styles cannot overlap.
+func (in *inlineParser) parse(start, end int, style textStyle) []inlinePart {
+	text := in.text
+	var parts []inlinePart
+	textStart := start
+	flushText := func(to int) {
+		if textStart < to {
+			parts = append(parts, inlinePart{styledText(softBreaks(text[textStart:to]), style), textStart, to})
+		}
+	}
+
+	i := start
+	for i < end {
+		if n := in.codeEnd(i, end); n != -1 {
+			flushText(i)
+			parts = append(parts, inlinePart{docCode(softBreaks(text[i+1 : n-1])), i, n})
+			i, textStart = n, n
+			continue
+		}
+		if ok, ref, subRef, n := in.refEnd(i, end); ok {
+			flushText(i)
+			parts = append(parts, inlinePart{in.p.refPart(ref, subRef, in.line(i), style), i, n})
+			i, textStart = n, n
+			continue
+		}
+		if text[i] == '`' && bytes.IndexByte(text[i+1:end], '`') == -1 {
+			in.warn(i, "'`' is not closed, write [`] if it is meant literally")
+		}
 
-				i = 0
-				line = rest
+		s, ok := inlineStyleAt(text[i:end])
+		if !ok {
+			i++
+			continue
+		}
+		after := i + len(s.delim)
+		opens := after < end && !isSpaceOrBreak(text[after]) && style&s.style == 0 &&
+			!(style&superOrSub != 0 && s.style&superOrSub != 0)
+		if s.noSpaces {
+			opens = opens && startsScript(text[after:end])
+		} else {
+			opens = opens && opensStyle(text, i)
+		}
+		if opens {
+			close := in.styleEnd(after, s)
+			if close != -1 && close+len(s.delim) <= end {
+				flushText(i)
+				inner := in.parse(after, close, style|s.style)
+				// the styled text includes its delimiters
+				inner[0].from = i
+				inner[len(inner)-1].to = close + len(s.delim)
+				parts = append(parts, inner...)
+				i = close + len(s.delim)
+				textStart = i
 				continue
 			}
+			// a word with more delimiters, like the path /usr/bin, is not
+			// meant to be styled
+			wordEnd := after
+			for wordEnd < end && !isSpaceOrBreak(text[wordEnd]) {
+				wordEnd++
+			}
+			pathLike := bytes.Contains(text[after:wordEnd], []byte(s.delim))
+			if close == -1 && !s.noSpaces && !pathLike && (i == 0 || isSpaceOrBreak(text[i-1])) {
+				in.warn(i, fmt.Sprintf(
+					"'%s' is not closed, write [%c]%s if it is meant literally",
+					s.delim, s.delim[0], s.delim[1:],
+				))
+			}
+		}
+		// skip the whole delimiter so "~~" is not taken for "~"
+		i = after
+	}
+	flushText(end)
+	return parts
+}
+
+// styleEnd returns the offset of the delimiter that closes the style whose
+// text starts at start or -1 if there is none. Code and references are
+// skipped, a delimiter inside them does not close the style.
+func (in *inlineParser) styleEnd(start int, s inlineStyle) int {
+	text := in.text
+	delim := []byte(s.delim)
+	for i := start; i < len(text); {
+		if s.noSpaces && isSpaceOrBreak(text[i]) {
+			return -1
+		}
+		if n := in.codeEnd(i, len(text)); n != -1 {
+			i = n
+			continue
+		}
+		if ok, _, _, n := in.refEnd(i, len(text)); ok {
+			i = n
+			continue
+		}
+		if i > start && bytes.HasPrefix(text[i:], delim) && !isSpaceOrBreak(text[i-1]) &&
+			(s.noSpaces || closesStyle(text, i+len(delim))) {
+			return i
 		}
 		i++
 	}
+	return -1
+}
 
-	if len(line) > 0 {
-		p.emit(docText(line))
+// codeEnd returns the offset behind the code that starts at i, or -1 if there
+// is no code at i.
+func (in *inlineParser) codeEnd(i, end int) int {
+	if in.text[i] != '`' {
+		return -1
+	}
+	n := bytes.IndexByte(in.text[i+1:end], '`')
+	if n <= 0 {
+		return -1
 	}
+	return i + n + 2
+}
+
+// refEnd parses a reference in brackets that starts at i, see findRefEnd. n is
+// the offset behind it. References cannot span lines.
+func (in *inlineParser) refEnd(i, end int) (ok bool, ref, subRef string, n int) {
+	if in.text[i] != '[' {
+		return false, "", "", -1
+	}
+	ok, ref, subRef, rest := findRefEnd(in.text[i+1 : end])
+	n = end - len(rest)
+	if !ok || bytes.IndexByte(in.text[i:n], '\n') != -1 {
+		return false, "", "", -1
+	}
+	return true, ref, subRef, n
+}
+
+// refPart returns the part for a reference in brackets, see findRefEnd.
+// Variables and escaped characters get the style of the surrounding text.
+func (p *parser) refPart(ref, subRef string, line int, style textStyle) docPart {
+	if subRef != "" {
+		return tempRef{text: ref, target: subRef, declLine: line, style: style}
+	}
+	if v, ok := p.vars[ref]; ok {
+		return styledText(v.text, style)
+	}
+	if len(ref) == 1 && strings.Contains("[*/=-.\\`_~^!", ref) {
+		return styledText(ref, style)
+	}
+	if strings.HasPrefix(ref, keyPrefix) && len(ref) > len(keyPrefix) {
+		return docKey(ref[len(keyPrefix):])
+	}
+	if strings.HasPrefix(ref, footnotePrefix) && validID(ref[len(footnotePrefix):]) {
+		return p.footnoteRef(ref[len(footnotePrefix):], line)
+	}
+	if hasImageExt(ref) {
+		return docImage{name: ref}
+	}
+	return tempRef{target: ref, declLine: line, style: style}
+}
+
+func (in *inlineParser) warn(offset int, msg string) {
+	if in.p.warn != nil {
+		in.p.warn(in.line(offset), msg)
+	}
+}
+
+// lineIndex returns the index of the line that the text offset is in.
+func (in *inlineParser) lineIndex(offset int) int {
+	return sort.Search(len(in.starts), func(i int) bool {
+		return in.starts[i] > offset
+	}) - 1
+}
+
+func (in *inlineParser) line(offset int) int {
+	return in.numbers[in.lineIndex(offset)]
+}
+
+func (in *inlineParser) pos(offset int) sourcePos {
+	i := in.lineIndex(offset)
+	return sourcePos{
+		line:   in.numbers[i],
+		column: utf8.RuneCount(in.text[in.starts[i]:offset]) + 1,
+	}
+}
+
+// styledText is plain text if there is no style.
+func styledText(text string, style textStyle) docPart {
+	if style == 0 {
+		return docText(text)
+	}
+	return stylizedDocText{text: text, style: style}
+}
+
+// softBreaks replaces the line breaks between joined lines with spaces.
+func softBreaks(text []byte) string {
+	return strings.Replace(string(text), "\n", " ", -1)
 }
 
 func (p *parser) replaceVars(text string) string {
@@ -322,17 +959,89 @@ func (p *parser) replaceFirstVar(text string) (string, bool, int) {
 
 func (tempRef) isDocPart() {}
 
+// keyPrefix starts a reference to a keyboard key, e.g. [key:Ctrl+S].
+const keyPrefix = "key:"
+
+// footnotePrefix starts a reference to a footnote, e.g. [^1].
+const footnotePrefix = "^"
+
 func isSpace(b byte) bool {
 	return b == ' ' || b == '\t'
 }
 
-func findStyleEnd(line []byte, delim byte) int {
-	for i, b := range line {
-		if b == delim && i > 0 && !isSpace(line[i-1]) {
-			return i + 1
+func isSpaceOrBreak(b byte) bool {
+	return isSpace(b) || b == '\n'
+}
+
+// opensStyle reports whether the delimiter at text[i] can open a style. It has
+// to start a word, so it is at the start or after a space or punctuation, this
+// way and/or, x==y and my__var__name stay as they are. A dot belongs to a
+// name, like in self.__init__.
+func opensStyle(text []byte, i int) bool {
+	if i == 0 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRune(text[:i])
+	return unicode.IsSpace(r) || isPunct(r) && r != '.'
+}
+
+// closesStyle reports whether a delimiter that ends before text[i] can close a
+// style. It has to end a word, so it is at the end or before a space or
+// punctuation. A call continues with '(' and a file name with a dot and its
+// extension, like in __init__() and __init__.py.
+func closesStyle(text []byte, i int) bool {
+	if i == len(text) {
+		return true
+	}
+	r, size := utf8.DecodeRune(text[i:])
+	if r == '.' {
+		next, _ := utf8.DecodeRune(text[i+size:])
+		return i+size == len(text) || !unicode.IsLetter(next) && !unicode.IsDigit(next)
+	}
+	return unicode.IsSpace(r) || isPunct(r) && r != '('
+}
+
+// startsScript reports whether sub- or superscript text can start the text.
+// Sub- and superscripts are part of a word, like in x^2^ and H~2~O, so they
+// do not need a word boundary. Instead they cannot start with a slash, a
+// backslash or a dot, this way paths like ~/a~b and ~/.config~ stay as they
+// are.
+func startsScript(text []byte) bool {
+	return text[0] != '/' && text[0] != '\\' && text[0] != '.'
+}
+
+func isPunct(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+// inlineStyle is the markup of a text style, the styled text is enclosed in
+// delim. Sub- and superscripts cannot contain spaces, this way a single '~' or
+// '^' in normal text, like in a path or formula, is not taken for markup.
+type inlineStyle struct {
+	delim    string
+	style    textStyle
+	noSpaces bool
+}
+
+// inlineStyles has the longer delimiters first so "~~" is not taken for "~".
+var inlineStyles = []inlineStyle{
+	{delim: "*", style: styleBold},
+	{delim: "/", style: styleItalic},
+	{delim: "__", style: styleUnderline},
+	{delim: "~~", style: styleStrike},
+	{delim: "==", style: styleHighlight},
+	{delim: "^", style: styleSuper, noSpaces: true},
+	{delim: "~", style: styleSub, noSpaces: true},
+}
+
+// inlineStyleAt returns the style whose delimiter starts the line.
+func inlineStyleAt(line []byte) (inlineStyle, bool) {
+	for _, s := range inlineStyles {
+		if bytes.HasPrefix(line, []byte(s.delim)) {
+			return s, true
 		}
 	}
-	return -1
+	return inlineStyle{}, false
 }
 
 func findRefEnd(line []byte) (found bool, ref, subRef string, rest []byte) {
@@ -393,100 +1102,211 @@ type tempRef struct {
 	declLine int
 	target   string
 	text     string
+	style    textStyle
 }
 
-func (p *parser) resolveRefs() {
-	// first find all referenced texts
-	referenced := make(map[string]bool)
-	for _, part := range p.doc.parts {
-		if ref, ok := part.(tempRef); ok {
-			referenced[ref.target] = true
-		}
-	}
-	// add link targets for all referenced texts
-	targets := make(map[string]int)
-	i := 0
-	addTarget := func(ref string) {
-		if referenced[ref] {
-			id := len(targets) + 1
-			targets[ref] = id
-			// insert this target into the document
-			p.doc.parts = append(p.doc.parts, nil)
-			copy(p.doc.parts[i+1:], p.doc.parts[i:])
-			p.doc.parts[i] = docLinkTarget(id)
-			i++
+// assignIDs gives every caption that has no explicit id a unique id generated
+// from its text. Explicit ids must be unique.
+func (p *parser) assignIDs() {
+	used := make(map[string]bool)
+	firstLine := make(map[string]int)
+	for i, part := range p.doc.parts {
+		if h, _, ok := headingOf(part); ok && h.id != "" {
+			line := p.doc.position(i).start.line
+			if used[h.id] {
+				p.err = errorInLine(
+					line,
+					"caption id '%s' in line %d is used more than once, it is first used in line %d",
+					h.id, line, firstLine[h.id],
+				)
+				return
+			}
+			used[h.id] = true
+			firstLine[h.id] = line
 		}
 	}
-	for i < len(p.doc.parts) {
-		part := p.doc.parts[i]
-		if title, ok := part.(docTitle); ok {
-			addTarget(string(title))
-		}
-		if caption, ok := part.(docCaption); ok {
-			addTarget(string(caption))
+
+	for i, part := range p.doc.parts {
+		if h, level, ok := headingOf(part); ok {
+			if h.id == "" {
+				base := slug(h.text)
+				h.id = base
+				for n := 2; used[h.id]; n++ {
+					h.id = fmt.Sprintf("%s-%d", base, n)
+				}
+				used[h.id] = true
+				p.doc.parts[i] = withHeading(h, level)
+			}
 		}
-		if caption, ok := part.(docSubCaption); ok {
-			addTarget(string(caption))
+	}
+}
+
+func (p *parser) resolveRefs() {
+	p.assignIDs()
+	if p.err != nil {
+		return
+	}
+	p.err = resolveRefsIn(p.doc.parts, captionPaths(p.doc))
+}
+
+// resolveRefsIn replaces all tempRefs in the parts and in the content of
+// admonitions and footnotes with actual references.
+func resolveRefsIn(parts []docPart, captions []captionPath) error {
+	for i, part := range parts {
+		var content []docPart
+		switch p := part.(type) {
+		case docAdmonition:
+			content = p.content.parts
+		case docFootnote:
+			content = p.content.parts
 		}
-		if caption, ok := part.(docSubSubCaption); ok {
-			addTarget(string(caption))
+		if err := resolveRefsIn(content, captions); err != nil {
+			return err
 		}
-		i++
-	}
-	// replace all tempRefs with actual references
-	for i, part := range p.doc.parts {
 		if ref, ok := part.(tempRef); ok {
-			target := targets[ref.target]
-			if target == 0 {
-				// in this case, check if we have a URL
-				if strings.HasPrefix(ref.target, "www.") ||
-					strings.HasPrefix(ref.target, "http://") ||
-					strings.HasPrefix(ref.target, "https://") {
-					text := ref.text
-					if text == "" {
-						text = ref.target
-					}
-					url := ref.target
-					if strings.HasPrefix(url, "www.") {
-						url = "http://" + url
-					}
-					p.doc.parts[i] = externalDocLink{
-						url:  url,
-						text: text,
-					}
-					continue
-				}
-				// see if this is a mail address
-				possibleAddr := strings.TrimPrefix(ref.target, "mailto:")
-				if addr, err := mail.ParseAddress(possibleAddr); err == nil {
-					text := ref.text
-					if text == "" {
-						text = addr.Address
-					}
-					p.doc.parts[i] = externalDocLink{
-						url:  "mailto:" + addr.Address,
-						text: text,
-					}
+			matches := matchCaptions(captions, ref.target)
+			if len(matches) > 1 {
+				return ambiguousRefError(ref, matches)
+			}
+			if len(matches) == 0 {
+				if link, ok := externalLink(ref); ok {
+					parts[i] = link
 					continue
 				}
 				// neither a known internal link target nor a valid external
 				// link -> error
-				p.err = fmt.Errorf(
+				return errorInLine(
+					ref.declLine,
 					"unknown link target '%s' in line %d",
 					ref.target,
 					ref.declLine,
 				)
-				return
 			}
 			text := ref.text
 			if text == "" {
 				text = ref.target
 			}
-			p.doc.parts[i] = docLink{
-				id:   targets[ref.target],
-				text: text,
+			parts[i] = docLink{
+				id:    matches[0].id,
+				text:  text,
+				style: ref.style,
+			}
+		}
+	}
+	return nil
+}
+
+// externalLink returns the link for a reference to a web site or mail address.
+// ok is false if the reference target is neither.
+func externalLink(ref tempRef) (link externalDocLink, ok bool) {
+	if strings.HasPrefix(ref.target, "www.") ||
+		strings.HasPrefix(ref.target, "http://") ||
+		strings.HasPrefix(ref.target, "https://") {
+		text := ref.text
+		if text == "" {
+			text = ref.target
+		}
+		url := ref.target
+		if strings.HasPrefix(url, "www.") {
+			url = "http://" + url
+		}
+		return externalDocLink{url: url, text: text, style: ref.style}, true
+	}
+	// see if this is a mail address
+	possibleAddr := strings.TrimPrefix(ref.target, "mailto:")
+	if addr, err := mail.ParseAddress(possibleAddr); err == nil {
+		text := ref.text
+		if text == "" {
+			text = addr.Address
+		}
+		return externalDocLink{url: "mailto:" + addr.Address, text: text, style: ref.style}, true
+	}
+	return externalDocLink{}, false
+}
+
+// captionPath is a caption with its position in the heading hierarchy.
+type captionPath struct {
+	// path are the texts of all captions above this one, from the title
+	// down, and of this caption as the last element
+	path []string
+	id   string
+	line int
+}
+
+// captionPaths lists all captions of the document in order.
+func captionPaths(doc document) []captionPath {
+	var captions []captionPath
+	// parents are the captions above the current one, with their levels
+	var parents []string
+	var levels []int
+	for i, part := range doc.parts {
+		h, level, ok := headingOf(part)
+		if !ok {
+			continue
+		}
+		for len(levels) > 0 && levels[len(levels)-1] >= level {
+			parents = parents[:len(parents)-1]
+			levels = levels[:len(levels)-1]
+		}
+		path := append(append([]string{}, parents...), h.text)
+		line := doc.position(i).start.line
+		captions = append(captions, captionPath{path: path, id: h.id, line: line})
+		parents = append(parents, h.text)
+		levels = append(levels, level)
+	}
+	return captions
+}
+
+// matchCaptions returns all captions that a link target refers to. The target
+// is either a caption text or a qualified path of the form "Parent > Caption"
+// where the parents do not have to be direct parents, e.g. "Export > Options"
+// matches the caption "Options" below the caption "Export" which is below the
+// title. Exact caption texts take precedence over paths.
+func matchCaptions(captions []captionPath, target string) []captionPath {
+	var matches []captionPath
+	for _, c := range captions {
+		if c.path[len(c.path)-1] == target {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) > 0 || !strings.Contains(target, ">") {
+		return matches
+	}
+
+	segments := strings.Split(target, ">")
+	for i := range segments {
+		segments[i] = strings.TrimSpace(segments[i])
+	}
+	last := segments[len(segments)-1]
+	for _, c := range captions {
+		if c.path[len(c.path)-1] != last {
+			continue
+		}
+		// the parent segments must appear in order among the parents
+		parents, seg := c.path[:len(c.path)-1], 0
+		for _, parent := range parents {
+			if seg < len(segments)-1 && parent == segments[seg] {
+				seg++
 			}
-			referenced[ref.text] = true
 		}
+		if seg == len(segments)-1 {
+			matches = append(matches, c)
+		}
+	}
+	return matches
+}
+
+func ambiguousRefError(ref tempRef, matches []captionPath) error {
+	lines := make([]string, len(matches))
+	for i, m := range matches {
+		lines[i] = fmt.Sprint(m.line)
+	}
+	msg := fmt.Sprintf(
+		"link target '%s' in line %d is ambiguous, it matches the captions in lines %s",
+		ref.target, ref.declLine, strings.Join(lines, ", "),
+	)
+	if path := matches[0].path; len(path) >= 2 {
+		msg += fmt.Sprintf(", use a path like [%s > %s]", path[len(path)-2], path[len(path)-1])
 	}
+	return lineError{line: ref.declLine, msg: msg}
 }
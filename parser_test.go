@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 )
@@ -10,7 +11,7 @@ func TestDocumentTitle(t *testing.T) {
 		t,
 		"=====\nTitle\n=====",
 		"Title",
-		docTitle("Title"),
+		docTitle{text: "Title", id: "title"},
 	)
 }
 
@@ -23,8 +24,8 @@ Title
 Caption
 =======`,
 		"Title",
-		docTitle("Title"),
-		docCaption("Caption"),
+		docTitle{text: "Title", id: "title"},
+		docCaption{text: "Caption", id: "caption"},
 	)
 }
 
@@ -47,7 +48,7 @@ func TestTitlesAreNeverStylized(t *testing.T) {
 		t,
 		"===\n"+title+"\n===",
 		title,
-		docTitle(title),
+		docTitle{text: title, id: "no-bold-nor-italic-nor-references"},
 	)
 }
 
@@ -56,17 +57,57 @@ func TestSingleLineOfText(t *testing.T) {
 	checkParse(t, text, "", docText(text))
 }
 
-func TestTwoLinesOfText(t *testing.T) {
-	const text = "Line one\nLine two"
-	checkParse(t, text, "", docText(text))
+func TestTwoLinesOfTextAreJoinedWithASpace(t *testing.T) {
+	checkParse(t, "Line one\nLine two", "", docText("Line one Line two"))
+	checkParse(t, "Line one  \nLine two", "", docText("Line one Line two"))
 }
 
 func TestWindowsLineBreaksAreReplacedWithUnix(t *testing.T) {
-	checkParse(t, "Line one\r\nLine two", "", docText("Line one\nLine two"))
+	checkParse(t, "Line one\r\nLine two", "", docText("Line one Line two"))
 }
 
 func TestOldMaxLineBreaksAreReplacedWithUnix(t *testing.T) {
-	checkParse(t, "Line one\rLine two", "", docText("Line one\nLine two"))
+	checkParse(t, "Line one\rLine two", "", docText("Line one Line two"))
+}
+
+func TestEmptyLinesBreakParagraphs(t *testing.T) {
+	checkParse(
+		t,
+		"\nOne\n\n  \nTwo\nstill two\n\n",
+		"",
+		docText("One"),
+		docParagraphBreak{},
+		docText("Two still two"),
+	)
+}
+
+func TestBackslashAtLineEndIsLineBreak(t *testing.T) {
+	checkParse(
+		t,
+		"One \\\n*Two*\\\n\nThree",
+		"",
+		docText("One"),
+		docLineBreak{},
+		bold("Two"),
+		docParagraphBreak{},
+		docText("Three"),
+	)
+	checkParse(t, `C:[\]`, "", docText(`C:\`))
+}
+
+func TestCaptionsAreNotPartOfParagraphs(t *testing.T) {
+	checkParse(
+		t,
+		`One
+
+Caption
+-------
+Two`,
+		"",
+		docText("One"),
+		docSubCaption{text: "Caption", id: "caption"},
+		docText("Two"),
+	)
 }
 
 func TestVariablesCanOnlyBeDefinedOnce(t *testing.T) {
@@ -130,16 +171,73 @@ func TestCaptionsCanHaveVariables(t *testing.T) {
 	checkParse(t, `===
 [title]
 ===
-[\title=abc]`, "abc", docTitle("abc"))
+[\title=abc]`, "abc", docTitle{text: "abc", id: "abc"})
+}
+
+func TestStylesCanBeNested(t *testing.T) {
+	checkParse(
+		t,
+		"*bold /and italic!/ bold again*",
+		"",
+		bold("bold "),
+		boldItalic("and italic!"),
+		bold(" bold again"),
+	)
 }
 
-func TestStylesAreNotNested(t *testing.T) {
+func TestStyledTextCanContainLinksAndCode(t *testing.T) {
 	checkParse(
 		t,
-		"*bold /NOT italic!/ bold again*",
+		`Caption
+-------
+*see [Caption], [www.a.com] and `+"`x*y`"+` [key:F1] [a.png]*`,
 		"",
-		bold("bold /NOT italic!/ bold again"),
+		docSubCaption{text: "Caption", id: "caption"},
+		bold("see "),
+		docLink{id: "caption", text: "Caption", style: styleBold},
+		bold(", "),
+		externalDocLink{url: "http://www.a.com", text: "www.a.com", style: styleBold},
+		bold(" and "),
+		docCode("x*y"),
+		bold(" "),
+		docKey("F1"),
+		bold(" "),
+		docImage{name: "a.png"},
+	)
+}
+
+func TestStylesCanSpanSoftLineBreaks(t *testing.T) {
+	checkParse(t, "*bold\nstill bold* not\\\n*not bold*", "",
+		bold("bold still bold"),
+		docText(" not"),
+		docLineBreak{},
+		bold("not bold"),
 	)
+	checkParse(t, "*bold\\\nnot*", "",
+		docText("*bold"),
+		docLineBreak{},
+		docText("not*"),
+	)
+	checkParse(t, "*bold\n\nnot*", "",
+		docText("*bold"),
+		docParagraphBreak{},
+		docText("not*"),
+	)
+	checkParse(t, "use and/or here\nand client/server there", "",
+		docText("use and/or here and client/server there"),
+	)
+}
+
+func TestStylesStartAndEndAtWordBoundaries(t *testing.T) {
+	checkParse(t, "(*bold*), \"/italic/\" and *a*b*", "",
+		docText("("),
+		bold("bold"),
+		docText("), \""),
+		italic("italic"),
+		docText("\" and "),
+		bold("a*b"),
+	)
+	checkParse(t, "1/2/3 and a*b*c", "", docText("1/2/3 and a*b*c"))
 }
 
 func TestParseStyles(t *testing.T) {
@@ -153,6 +251,53 @@ func TestParseStyles(t *testing.T) {
 	)
 }
 
+func TestMoreTextStyles(t *testing.T) {
+	checkParse(t, "__under__ ~~strike~~ ==mark==", "",
+		styled("under", styleUnderline),
+		docText(" "),
+		styled("strike", styleStrike),
+		docText(" "),
+		styled("mark", styleHighlight),
+	)
+	checkParse(t, "x^2^ H~2~O", "",
+		docText("x"),
+		styled("2", styleSuper),
+		docText(" H"),
+		styled("2", styleSub),
+		docText("O"),
+	)
+	checkParse(t, "Brand® and Brand^®^", "",
+		docText("Brand® and Brand"),
+		styled("®", styleSuper),
+	)
+}
+
+func TestStylesCanBeCombined(t *testing.T) {
+	checkParse(t, "*__~~all~~__*", "", styled("all", styleBold|styleUnderline|styleStrike))
+	checkParse(t, "==/marked/==", "", styled("marked", styleHighlight|styleItalic))
+	checkParse(t, "^~x~^", "", styled("~x~", styleSuper))
+}
+
+func TestSubAndSuperscriptsCannotContainSpaces(t *testing.T) {
+	checkParse(t, "a~b c~d", "", docText("a~b c~d"))
+	checkParse(t, "2^n and 3^m", "", docText("2^n and 3^m"))
+	checkParse(t, "snake_case_name", "", docText("snake_case_name"))
+}
+
+func TestStyleCharactersInsideWordsAreText(t *testing.T) {
+	for _, text := range []string{
+		"my__var__name",
+		"self.__init__() in __init__.py",
+		"x==y==z",
+		"a~~b~~c",
+		"~/a~b",
+		"~/.config~",
+		`C:\a^\b^`,
+	} {
+		checkParse(t, text, "", docText(text))
+	}
+}
+
 func TestEsacpedSpecialCharacter(t *testing.T) {
 	checkParse(t, "[*]", "", docText("*"))
 	checkParse(t, "[[]", "", docText("["))
@@ -160,6 +305,9 @@ func TestEsacpedSpecialCharacter(t *testing.T) {
 	checkParse(t, "[=]", "", docText("="))
 	checkParse(t, "[-]", "", docText("-"))
 	checkParse(t, "[.]", "", docText("."))
+	checkParse(t, "[_]_x__", "", docText("__x__"))
+	checkParse(t, "[~]", "", docText("~"))
+	checkParse(t, "[^]", "", docText("^"))
 }
 
 func TestImageRefsHaveImageExtension(t *testing.T) {
@@ -186,10 +334,9 @@ Subchapter
 Subsubchapter
 .............`,
 		"",
-		docText("\n"),
-		docCaption("Chapter"),
-		docSubCaption("Subchapter"),
-		docSubSubCaption("Subsubchapter"),
+		docCaption{text: "Chapter", id: "chapter"},
+		docSubCaption{text: "Subchapter", id: "subchapter"},
+		docSubSubCaption{text: "Subsubchapter", id: "subsubchapter"},
 	)
 }
 
@@ -204,10 +351,9 @@ Caption 2
 Caption 3
 =========`,
 		"",
-		docText("\n"),
-		docCaption("Caption 1"),
-		docCaption("Caption 2"),
-		docCaption("Caption 3"),
+		docCaption{text: "Caption 1", id: "caption-1"},
+		docCaption{text: "Caption 2", id: "caption-2"},
+		docCaption{text: "Caption 3", id: "caption-3"},
 	)
 }
 
@@ -217,7 +363,7 @@ func TestSingleChapterCaption(t *testing.T) {
 		`chap 1
 =====`,
 		"",
-		docCaption("chap 1"),
+		docCaption{text: "chap 1", id: "chap-1"},
 	)
 }
 
@@ -228,9 +374,63 @@ func TestRefsToCaptionsAreResolved(t *testing.T) {
 =====
 [chap 1]`,
 		"",
-		docLinkTarget(1),
-		docCaption("chap 1"),
-		docLink{id: 1, text: "chap 1"},
+		docCaption{text: "chap 1", id: "chap-1"},
+		docLink{id: "chap-1", text: "chap 1"},
+	)
+}
+
+func TestCaptionIDsAreSlugsOfTheirText(t *testing.T) {
+	checkParse(
+		t,
+		`Über uns
+========
+What's new? (v2.0)
+------------------`,
+		"",
+		docCaption{text: "Über uns", id: "über-uns"},
+		docSubCaption{text: "What's new? (v2.0)", id: "what-s-new-v2-0"},
+	)
+}
+
+func TestDuplicateCaptionIDsAreNumbered(t *testing.T) {
+	checkParse(
+		t,
+		`Options
+=======
+Options
+-------
+Options
+.......`,
+		"",
+		docCaption{text: "Options", id: "options"},
+		docSubCaption{text: "Options", id: "options-2"},
+		docSubSubCaption{text: "Options", id: "options-3"},
+	)
+}
+
+func TestCaptionIDsCanBeGivenExplicitly(t *testing.T) {
+	checkParse(
+		t,
+		`Options
+=======
+Settings {#options}
+-------------------
+[Settings]`,
+		"",
+		docCaption{text: "Options", id: "options-2"},
+		docSubCaption{text: "Settings", id: "options"},
+		docLink{id: "options", text: "Settings"},
+	)
+}
+
+func TestExplicitCaptionIDsMustBeUnique(t *testing.T) {
+	checkParseError(
+		t,
+		`One {#id}
+=========
+Two {#id}
+=========`,
+		"caption id 'id' in line 3 is used more than once, it is first used in line 1",
 	)
 }
 
@@ -238,6 +438,75 @@ func TestUnknownRefTargetIsError(t *testing.T) {
 	checkParseError(t, "[who]", "unknown link target 'who' in line 1")
 }
 
+func TestRefsToDuplicateCaptionsAreAmbiguous(t *testing.T) {
+	checkParseError(
+		t,
+		`Export
+======
+Options
+-------
+Import
+======
+Options
+-------
+[Options]`,
+		"link target 'Options' in line 9 is ambiguous, it matches the captions in lines 3, 7, use a path like [Export > Options]",
+	)
+}
+
+func TestRefsCanBeQualifiedWithParentCaptions(t *testing.T) {
+	checkParse(
+		t,
+		`=====
+Tool
+=====
+Export
+======
+Options
+-------
+Import
+======
+Options
+-------
+Details
+.......
+[Export > Options] [Import>Options] [Tool > Import > Details] [more[Import > Options]]`,
+		"Tool",
+		docTitle{text: "Tool", id: "tool"},
+		docCaption{text: "Export", id: "export"},
+		docSubCaption{text: "Options", id: "options"},
+		docCaption{text: "Import", id: "import"},
+		docSubCaption{text: "Options", id: "options-2"},
+		docSubSubCaption{text: "Details", id: "details"},
+		docLink{id: "options", text: "Export > Options"},
+		docText(" "),
+		docLink{id: "options-2", text: "Import>Options"},
+		docText(" "),
+		docLink{id: "details", text: "Tool > Import > Details"},
+		docText(" "),
+		docLink{id: "options-2", text: "more"},
+	)
+	checkParseError(t, "A\n===\n[B > A]", "unknown link target 'B > A' in line 3")
+}
+
+func TestCaptionTextsTakePrecedenceOverPaths(t *testing.T) {
+	checkParse(
+		t,
+		`A > B
+=====
+A
+=====
+B
+-----
+[A > B]`,
+		"",
+		docCaption{text: "A > B", id: "a-b"},
+		docCaption{text: "A", id: "a"},
+		docSubCaption{text: "B", id: "b"},
+		docLink{id: "a-b", text: "A > B"},
+	)
+}
+
 func TestRefsToCaptionsCanHaveDifferentText(t *testing.T) {
 	checkParse(
 		t,
@@ -245,9 +514,8 @@ func TestRefsToCaptionsCanHaveDifferentText(t *testing.T) {
 ------
 [this is a link[chap 1]]`,
 		"",
-		docLinkTarget(1),
-		docSubCaption("chap 1"),
-		docLink{id: 1, text: "this is a link"},
+		docSubCaption{text: "chap 1", id: "chap-1"},
+		docLink{id: "chap-1", text: "this is a link"},
 	)
 }
 
@@ -285,6 +553,169 @@ func TestMailAddressRefsAreLinksWith_mailto_prefixedIfNecessary(t *testing.T) {
 	})
 }
 
+func TestCodeIsLiteral(t *testing.T) {
+	checkParse(t, "[\\v=x]\nrun `go *build* [v]` now", "",
+		docText("run "),
+		docCode("go *build* [v]"),
+		docText(" now"),
+	)
+	checkParse(t, "a [`]b[`] and ``", "", docText("a `b` and ``"))
+}
+
+func TestKeysAreWrittenWithKeyPrefix(t *testing.T) {
+	checkParse(t, "press [key:Ctrl+S] to save", "",
+		docText("press "),
+		docKey("Ctrl+S"),
+		docText(" to save"),
+	)
+}
+
+func TestAdmonitionsHaveParagraphsOfTheirOwn(t *testing.T) {
+	doc, err := parse([]byte(`Caption
+=======
+before
+!!! Warning
+Back up your *data*
+before the [Caption].
+
+Second paragraph
+!!!
+after`))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	if len(doc.parts) != 4 {
+		t.Fatalf("want 4 parts but have %#v", doc.parts)
+	}
+	a, ok := doc.parts[2].(docAdmonition)
+	if !ok || a.kind != admonitionWarning {
+		t.Fatalf("want a warning but have %#v", doc.parts[2])
+	}
+	want := []docPart{
+		docText("Back up your "),
+		bold("data"),
+		docText(" before the "),
+		docLink{id: "caption", text: "Caption"},
+		docText("."),
+		docParagraphBreak{},
+		docText("Second paragraph"),
+	}
+	if !reflect.DeepEqual(a.content.parts, want) {
+		t.Errorf("want content\n%#v\nbut have\n%#v", want, a.content.parts)
+	}
+	if doc.parts[3] != docText("after") {
+		t.Errorf("want text after the admonition but have %#v", doc.parts[3])
+	}
+	if pos := doc.positions[2]; pos.start != (sourcePos{4, 1}) || pos.end != (sourcePos{9, 4}) {
+		t.Errorf("admonition has wrong position %v-%v", pos.start, pos.end)
+	}
+	if pos := a.content.positions[1]; pos.start != (sourcePos{5, 14}) {
+		t.Errorf("content has wrong position %v", pos.start)
+	}
+}
+
+func TestAdmonitionErrors(t *testing.T) {
+	checkParseError(t, "text\n!!! note\ntext",
+		"note in line 2 is not closed, end it with a line '!!!'")
+	checkParseError(t, "!!! note\n!!! tip\ntext\n!!!\n!!!",
+		"admonition in line 2 is inside the note in line 1, admonitions cannot be nested")
+	checkParseError(t, "!!! danger\nCaption\n-------\n!!!",
+		"caption in line 2 is inside the danger in line 1, admonitions cannot contain captions")
+	checkParse(t, "[!]!! note\n!!!", "", docText("!!! note !!!"))
+}
+
+func TestUnknownAdmonitionsAreText(t *testing.T) {
+	checkParse(t, "!!! IMPORTANT !!!\nRead this.", "", docText("!!! IMPORTANT !!! Read this."))
+	doc, err := parse([]byte("!!! note\n!!! hint\n!!!"))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	a, ok := doc.parts[0].(docAdmonition)
+	if !ok || !reflect.DeepEqual(a.content.parts, []docPart{docText("!!! hint")}) {
+		t.Errorf("want a note with text '!!! hint' but have %#v", doc.parts)
+	}
+}
+
+func TestFootnotesAreNumberedInOrderOfUse(t *testing.T) {
+	doc, err := parse([]byte(`first[^b] and second[^a].
+
+[^a]: Note *A*
+continues here.
+[^b]: Note B`))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	if len(doc.parts) != 5 {
+		t.Fatalf("want 5 parts but have %#v", doc.parts)
+	}
+	b, ok := doc.parts[1].(docFootnote)
+	if !ok || b.number != 1 || !reflect.DeepEqual(b.content.parts, []docPart{docText("Note B")}) {
+		t.Errorf("want footnote B with number 1 but have %#v", doc.parts[1])
+	}
+	a, ok := doc.parts[3].(docFootnote)
+	want := []docPart{docText("Note "), bold("A"), docText(" continues here.")}
+	if !ok || a.number != 2 || !reflect.DeepEqual(a.content.parts, want) {
+		t.Errorf("want footnote A with number 2 but have %#v", doc.parts[3])
+	}
+	if pos := a.content.positions[1]; pos.start != (sourcePos{3, 12}) {
+		t.Errorf("footnote content has wrong position %v", pos.start)
+	}
+	if doc.parts[4] != docText(".") {
+		t.Errorf("the definitions must not be part of the text but have %#v", doc.parts[4])
+	}
+}
+
+func TestFootnoteErrors(t *testing.T) {
+	checkParseError(t, "text[^a]",
+		"footnote 'a' in line 1 is not defined, define it in a line starting with [^a]:")
+	checkParseError(t, "text\n\n[^a]: note",
+		"footnote 'a' defined in line 3 is never used")
+	checkParseError(t, "text[^a] and[^a]\n\n[^a]: note",
+		"footnote 'a' is used in line 1 and line 1, each footnote can only be used once")
+	checkParseError(t, "text[^a]\n\n[^a]: note[^b]\n[^b]: other",
+		"footnote 'b' is used in a footnote in line 3, footnotes cannot be nested")
+	checkParseError(t, "text[^a]\n\n[^a]: note\n[^a]: other",
+		"footnote 'a' redefined in line 4, first definition was in line 3, each footnote can only be defined once")
+	checkParseError(t, "text[^a]\n\n[^a]:",
+		"footnote 'a' in line 3 has no text")
+	checkParseError(t, "a\n[^n]: note\nb[^n]",
+		"footnote 'n' in line 2 interrupts the paragraph in line 1, add an empty line before its definition")
+	checkParse(t, "[[]^a]: text", "", docText("[^a]: text"))
+}
+
+func TestFootnotesEndAtCaptionsAndAdmonitions(t *testing.T) {
+	doc, err := parse([]byte(`text[^a] and[^b].
+
+[^a]: note A
+Caption
+-------
+[^b]: note B
+!!! tip
+Tip
+!!!`))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	var types []string
+	notes := map[int]docPart{}
+	for _, part := range doc.parts {
+		types = append(types, fmt.Sprintf("%T", part))
+		if f, ok := part.(docFootnote); ok {
+			notes[f.number] = f.content.parts[0]
+		}
+	}
+	wantTypes := []string{
+		"main.docText", "main.docFootnote", "main.docText", "main.docFootnote", "main.docText",
+		"main.docSubCaption", "main.docAdmonition",
+	}
+	if !reflect.DeepEqual(types, wantTypes) {
+		t.Errorf("want parts\n%v\nbut have\n%v", wantTypes, types)
+	}
+	if notes[1] != docText("note A") || notes[2] != docText("note B") {
+		t.Errorf("wrong footnotes %v", notes)
+	}
+}
+
 func checkParse(t *testing.T, code string, title string, want ...docPart) {
 	doc, err := parse([]byte(code))
 	if err != nil {
@@ -325,23 +756,59 @@ func checkParseError(t *testing.T, code string, wantMsg string) {
 }
 
 func bold(s string) stylizedDocText {
-	return stylizedDocText{
-		bold: true,
-		text: s,
-	}
+	return styled(s, styleBold)
 }
 
 func italic(s string) stylizedDocText {
-	return stylizedDocText{
-		italic: true,
-		text:   s,
-	}
+	return styled(s, styleItalic)
 }
 
 func boldItalic(s string) stylizedDocText {
+	return styled(s, styleBold|styleItalic)
+}
+
+func styled(s string, style textStyle) stylizedDocText {
 	return stylizedDocText{
-		bold:   true,
-		italic: true,
-		text:   s,
+		text:  s,
+		style: style,
+	}
+}
+
+func TestPartsRecordTheirSourcePositions(t *testing.T) {
+	code := `Caption
+-------
+text *bold* [Caption]
+line`
+	doc, err := parseFile("help.txt", []byte(code))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	pos := func(line, col int) sourcePos { return sourcePos{line: line, column: col} }
+	want := []sourceRange{
+		{file: "help.txt", start: pos(1, 1), end: pos(1, 8)},
+		{file: "help.txt", start: pos(3, 1), end: pos(3, 6)},
+		{file: "help.txt", start: pos(3, 6), end: pos(3, 12)},
+		{file: "help.txt", start: pos(3, 12), end: pos(3, 13)},
+		{file: "help.txt", start: pos(3, 13), end: pos(3, 22)},
+		{file: "help.txt", start: pos(3, 22), end: pos(4, 5)},
+	}
+	if len(doc.positions) != len(doc.parts) {
+		t.Fatalf("have %d parts but %d positions", len(doc.parts), len(doc.positions))
+	}
+	if !reflect.DeepEqual(doc.positions, want) {
+		t.Errorf("want positions\n%v\nbut have\n%v", want, doc.positions)
+	}
+}
+
+func TestPositionColumnsCountCharacters(t *testing.T) {
+	doc, err := parse([]byte("äöü *x*"))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	if len(doc.positions) != 2 {
+		t.Fatalf("want 2 positions but have %v", doc.positions)
+	}
+	if have := doc.positions[1].start; have != (sourcePos{line: 1, column: 5}) {
+		t.Errorf("styled text should start in column 5 but starts at %v", have)
 	}
 }
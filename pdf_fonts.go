@@ -0,0 +1,136 @@
+package main
+
+// The PDF generator uses the standard Type 1 fonts which every PDF reader
+// provides, so no fonts need to be embedded. Their glyph widths are needed to
+// wrap lines. The widths are given in 1/1000 of the font size.
+
+type pdfFont int
+
+const (
+	helvetica pdfFont = iota
+	helveticaBold
+	helveticaOblique
+	helveticaBoldOblique
+	courier
+	courierBold
+	pdfFontCount
+)
+
+var pdfFontNames = [pdfFontCount]string{
+	"Helvetica",
+	"Helvetica-Bold",
+	"Helvetica-Oblique",
+	"Helvetica-BoldOblique",
+	"Courier",
+	"Courier-Bold",
+}
+
+// pdfFontForStyle returns the font for bold and italic text. The other styles
+// are drawn by pdfLayout.writeLine.
+func pdfFontForStyle(style textStyle) pdfFont {
+	return pdfFontFor(style.has(styleBold), style.has(styleItalic))
+}
+
+func pdfFontFor(bold, italic bool) pdfFont {
+	switch {
+	case bold && italic:
+		return helveticaBoldOblique
+	case bold:
+		return helveticaBold
+	case italic:
+		return helveticaOblique
+	}
+	return helvetica
+}
+
+// helveticaWidths are the widths of the ASCII characters from ' ' to '~'.
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+var helveticaBoldWidths = [95]int{
+	278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+	975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+	333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+	611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+}
+
+// winAnsiSpecials maps the characters of the WinAnsiEncoding range 0x80 to
+// 0x9F to their codes. The range 0xA0 to 0xFF is the same as in Unicode.
+var winAnsiSpecials = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E,
+	'‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+	'˜': 0x98, '™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// winAnsiSpecialWidths are the widths of the characters 0x80 to 0x9F, they are
+// the same for the regular and bold fonts.
+var winAnsiSpecialWidths = [32]int{
+	556, 0, 222, 556, 333, 1000, 556, 556, 333, 1000, 667, 333, 1000, 0, 611, 0,
+	0, 222, 222, 333, 333, 350, 556, 1000, 333, 1000, 500, 333, 944, 0, 500, 667,
+}
+
+// latin1Bases approximates the letters from 0xC0 to 0xFF with the width of
+// their base letter, '#' stands for the ligatures Æ and æ.
+const latin1Bases = "AAAAAA#CEEEEIIIIDNOOOOO+OUUUUYPsaaaaaa#ceeeeiiiidnooooo+ouuuuypy"
+
+// toWinAnsi encodes the text in the WinAnsiEncoding of the standard fonts.
+// Characters that cannot be encoded are replaced by '?'.
+func toWinAnsi(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r == '\t' {
+			b = append(b, "    "...)
+		} else if 32 <= r && r < 127 || 0xA0 <= r && r <= 0xFF {
+			b = append(b, byte(r))
+		} else if c, ok := winAnsiSpecials[r]; ok {
+			b = append(b, c)
+		} else {
+			b = append(b, '?')
+		}
+	}
+	return b
+}
+
+// textWidth returns the width in points of the WinAnsi encoded text.
+func textWidth(text []byte, font pdfFont, size float64) float64 {
+	if font == courier || font == courierBold {
+		// all Courier glyphs have the same width
+		return float64(len(text)*600) * size / 1000
+	}
+	widths := &helveticaWidths
+	if font == helveticaBold || font == helveticaBoldOblique {
+		widths = &helveticaBoldWidths
+	}
+	w := 0
+	for _, c := range text {
+		switch {
+		case 32 <= c && c < 127:
+			w += widths[c-32]
+		case 0x80 <= c && c < 0xA0:
+			w += winAnsiSpecialWidths[c-0x80]
+		case c >= 0xC0:
+			base := latin1Bases[c-0xC0]
+			if base == '#' {
+				w += 1000
+			} else if base == '+' {
+				w += widths['+'-32]
+			} else {
+				w += widths[base-32]
+			}
+		case c == 0xA0:
+			w += widths[0]
+		default:
+			w += 556
+		}
+	}
+	return float64(w) * size / 1000
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rtfOptions configure the fonts, colors and page layout of the generated RTF
+// document. All font sizes are given in half-points, all lengths in twips.
+type rtfOptions struct {
+	font        string
+	headingFont string
+	monoFont    string
+	fontSize    int
+	// headingSizes are the sizes for the title, captions, sub-captions and
+	// sub-sub-captions
+	headingSizes [4]int
+
+	linkColor    rtfColor
+	headingColor rtfColor
+
+	// paperWidth and paperHeight are 0 to use the reader's default paper,
+	// margins are 0 to use its default margins
+	paperWidth, paperHeight                          int
+	marginTop, marginRight, marginBottom, marginLeft int
+
+	// header and footer are written on every page, the placeholders {page}
+	// and {pages} are replaced by the current page number and the page count
+	header, footer string
+}
+
+type rtfColor struct {
+	r, g, b uint8
+}
+
+// hex returns the color in the form RRGGBB.
+func (c rtfColor) hex() string {
+	return fmt.Sprintf("%02X%02X%02X", c.r, c.g, c.b)
+}
+
+func defaultRTFOptions() rtfOptions {
+	return rtfOptions{
+		font:         "Calibri",
+		headingFont:  "Calibri",
+		monoFont:     "Consolas",
+		fontSize:     22,
+		headingSizes: [4]int{45, 40, 34, 22},
+		linkColor:    rtfColor{0x05, 0x63, 0xC1},
+		headingColor: rtfColor{0, 0, 0},
+	}
+}
+
+// paperSizes in twips, width x height
+var paperSizes = map[string][2]int{
+	"a3":     {16838, 23811},
+	"a4":     {11906, 16838},
+	"a5":     {8391, 11906},
+	"letter": {12240, 15840},
+	"legal":  {12240, 20160},
+}
+
+// rtfOptionSetters parse an option value and store it in the options. They are
+// used for the command line options, which are the names prefixed with a '-',
+// and for the lines of the RTF config file.
+var rtfOptionSetters = map[string]func(opts *rtfOptions, value string) error{
+	"font": func(opts *rtfOptions, name string) error {
+		opts.font = name
+		return nil
+	},
+	"heading-font": func(opts *rtfOptions, name string) error {
+		opts.headingFont = name
+		return nil
+	},
+	"mono-font": func(opts *rtfOptions, name string) error {
+		opts.monoFont = name
+		return nil
+	},
+	"font-size": func(opts *rtfOptions, size string) (err error) {
+		opts.fontSize, err = parseHalfPoints(size)
+		return
+	},
+	"heading-sizes": func(opts *rtfOptions, sizes string) error {
+		list := strings.Split(sizes, ",")
+		if len(list) != len(opts.headingSizes) {
+			return fmt.Errorf(
+				"heading-sizes needs %d comma-separated sizes, for the title and the three caption levels",
+				len(opts.headingSizes),
+			)
+		}
+		for i := range list {
+			size, err := parseHalfPoints(list[i])
+			if err != nil {
+				return err
+			}
+			opts.headingSizes[i] = size
+		}
+		return nil
+	},
+	"link-color": func(opts *rtfOptions, color string) (err error) {
+		opts.linkColor, err = parseColor(color)
+		return
+	},
+	"heading-color": func(opts *rtfOptions, color string) (err error) {
+		opts.headingColor, err = parseColor(color)
+		return
+	},
+	"paper": func(opts *rtfOptions, paper string) error {
+		if size, ok := paperSizes[strings.ToLower(paper)]; ok {
+			opts.paperWidth, opts.paperHeight = size[0], size[1]
+			return nil
+		}
+		parts := strings.Split(strings.ToLower(paper), "x")
+		if len(parts) == 2 {
+			w, errW := parseMillimeters(parts[0])
+			h, errH := parseMillimeters(parts[1])
+			if errW == nil && errH == nil {
+				opts.paperWidth, opts.paperHeight = w, h
+				return nil
+			}
+		}
+		return fmt.Errorf(
+			"invalid paper '%s', use one of %s or give the size in millimeters, e.g. 210x297",
+			paper, paperSizeNames(),
+		)
+	},
+	"margins": func(opts *rtfOptions, margins string) error {
+		list := strings.Split(margins, ",")
+		if len(list) != 1 && len(list) != 4 {
+			return errors.New("margins needs either one size for all margins or four sizes for top, right, bottom and left")
+		}
+		var m [4]int
+		for i := range m {
+			var err error
+			m[i], err = parseMillimeters(list[i%len(list)])
+			if err != nil {
+				return err
+			}
+		}
+		opts.marginTop, opts.marginRight, opts.marginBottom, opts.marginLeft = m[0], m[1], m[2], m[3]
+		return nil
+	},
+	"header": func(opts *rtfOptions, text string) error {
+		opts.header = text
+		return nil
+	},
+	"footer": func(opts *rtfOptions, text string) error {
+		opts.footer = text
+		return nil
+	},
+}
+
+// loadRTFConfig reads options from a config file. Each line has the form
+//
+//	name = value
+//
+// where name is one of the rtfOptionSetters. Empty lines and lines starting
+// with # are ignored.
+func loadRTFConfig(path string, opts *rtfOptions) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := bufio.NewScanner(bytes.NewReader(data))
+	lineNumber := 0
+	for lines.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq == -1 {
+			return fmt.Errorf("line %d: expected 'name = value' but got '%s'", lineNumber, line)
+		}
+		name := strings.TrimSpace(line[:eq])
+		value := strings.TrimSpace(line[eq+1:])
+		set, ok := rtfOptionSetters[name]
+		if !ok {
+			return fmt.Errorf("line %d: unknown option '%s'", lineNumber, name)
+		}
+		if err := set(opts, value); err != nil {
+			return fmt.Errorf("line %d: %s", lineNumber, err.Error())
+		}
+	}
+	return lines.Err()
+}
+
+// parseHalfPoints parses a font size given in points and returns it in
+// half-points, which is the unit that RTF uses.
+func parseHalfPoints(s string) (int, error) {
+	pt, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || pt <= 0 {
+		return 0, fmt.Errorf("invalid font size '%s', it must be a positive number of points", s)
+	}
+	return int(pt*2 + 0.5), nil
+}
+
+// parseMillimeters parses a length in millimeters and returns it in twips.
+func parseMillimeters(s string) (int, error) {
+	mm, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || mm < 0 {
+		return 0, fmt.Errorf("invalid length '%s', it must be a number of millimeters", s)
+	}
+	return int(mm*1440/25.4 + 0.5), nil
+}
+
+// parseColor parses a color of the form #RRGGBB.
+func parseColor(s string) (rtfColor, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 7 && s[0] == '#' {
+		if rgb, err := strconv.ParseUint(s[1:], 16, 32); err == nil {
+			return rtfColor{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb)}, nil
+		}
+	}
+	return rtfColor{}, fmt.Errorf("invalid color '%s', it must have the form #RRGGBB", s)
+}
+
+func paperSizeNames() string {
+	var names []string
+	for name := range paperSizes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}